@@ -0,0 +1,203 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records the actions users take through the bot. Entries are
+// only ever appended, to the log, a local file or a BigQuery table.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+)
+
+// Results of an action.
+const (
+	ResultDone   = "done"
+	ResultDenied = "denied"
+	ResultFailed = "failed"
+)
+
+// Entry is one action taken by a chat user.
+type Entry struct {
+	Time time.Time `json:"timestamp"`
+	// Platform is "slack" or "google".
+	Platform string `json:"platform"`
+	UserID   string `json:"userId"`
+	UserName string `json:"userName,omitempty"`
+	// Principal is the GCP principal the user is mapped to by the policy.
+	Principal string `json:"principal,omitempty"`
+	Action    string `json:"action"`
+	Project   string `json:"project"`
+	Location  string `json:"location"`
+	Pipeline  string `json:"pipeline"`
+	Release   string `json:"release"`
+	Rollout   string `json:"rollout,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Phase     string `json:"phase,omitempty"`
+	Job       string `json:"job,omitempty"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Summary is a short line about e to post under the message it was taken
+// from.
+func (e Entry) Summary() string {
+	who := e.UserName
+	if who == "" {
+		who = e.UserID
+	}
+	what := e.Rollout
+	if what == "" {
+		what = e.Release
+	}
+	return fmt.Sprintf("🧾 %s of %s by %s: %s, %s", e.Action, what, who, e.Result, e.Time.UTC().Format("2006-01-02 15:04:05 MST"))
+}
+
+// Sink appends entries somewhere.
+type Sink interface {
+	Write(ctx context.Context, e Entry) error
+}
+
+// Log writes the entries to the structured log, i.e. as JSON lines to stdout
+// which Cloud Logging picks up, under the "audit" key.
+var Log Sink = logSink{}
+
+type logSink struct{}
+
+func (logSink) Write(ctx context.Context, e Entry) error {
+	slog.InfoContext(ctx, "chat action", slog.Any("audit", e))
+	return nil
+}
+
+// Multi writes to every sink, carrying on when one fails.
+type Multi []Sink
+
+func (m Multi) Write(ctx context.Context, e Entry) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// File appends the entries as JSON lines to a local file.
+type File struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFile opens name for appending, creating it if needed.
+func OpenFile(name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit file: %v", err)
+	}
+	return &File{file: f}, nil
+}
+
+func (f *File) Write(ctx context.Context, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("could not write audit entry: %v", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+// BigQuery streams the entries into a table, whose columns are named after
+// the JSON fields of Entry. Options can point it at an emulator.
+type BigQuery struct {
+	// Table is PROJECT.DATASET.TABLE.
+	Table   string
+	Options []option.ClientOption
+
+	mu      sync.Mutex
+	service *bigquery.Service
+}
+
+// ParseTable splits PROJECT.DATASET.TABLE.
+func ParseTable(table string) (project string, dataset string, name string, err error) {
+	parts := strings.Split(table, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("audit table %q should look like PROJECT.DATASET.TABLE", table)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func (b *BigQuery) Write(ctx context.Context, e Entry) error {
+	project, dataset, table, err := ParseTable(b.Table)
+	if err != nil {
+		return err
+	}
+	service, err := b.api(ctx)
+	if err != nil {
+		return err
+	}
+
+	row := make(map[string]bigquery.JsonValue)
+	raw, _ := json.Marshal(e)
+	if err := json.Unmarshal(raw, &row); err != nil {
+		return err
+	}
+
+	resp, err := service.Tabledata.InsertAll(project, dataset, table, &bigquery.TableDataInsertAllRequest{
+		Rows: []*bigquery.TableDataInsertAllRequestRows{{Json: row}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not insert audit entry: %w", err)
+	}
+	if len(resp.InsertErrors) > 0 && len(resp.InsertErrors[0].Errors) > 0 {
+		return fmt.Errorf("could not insert audit entry: %s", resp.InsertErrors[0].Errors[0].Message)
+	}
+	return nil
+}
+
+func (b *BigQuery) api(ctx context.Context) (*bigquery.Service, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.service == nil {
+		// The service outlives the request which first needs it.
+		service, err := bigquery.NewService(context.WithoutCancel(ctx), b.Options...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create BigQuery service: %v", err)
+		}
+		b.service = service
+	}
+	return b.service, nil
+}
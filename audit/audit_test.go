@@ -0,0 +1,164 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+var entry = Entry{
+	Time:     time.Date(2021, 6, 2, 10, 0, 0, 0, time.UTC),
+	Platform: "slack",
+	UserID:   "U123",
+	UserName: "alice",
+	Action:   "promote",
+	Project:  "my-project",
+	Location: "us-central1",
+	Pipeline: "web-app",
+	Release:  "rel-2",
+	Rollout:  "rel-2-to-staging-0001",
+	Target:   "staging",
+	Result:   ResultDone,
+}
+
+func TestSummary(t *testing.T) {
+	var testTable = []struct {
+		name  string
+		entry Entry
+		want  string
+	}{
+		{"Rollout", entry, "🧾 promote of rel-2-to-staging-0001 by alice: done, 2021-06-02 10:00:00 UTC"},
+		{"Release and ID", Entry{Time: entry.Time, UserID: "U456", Action: "rollback", Release: "rel-1", Result: ResultDenied}, "🧾 rollback of rel-1 by U456: denied, 2021-06-02 10:00:00 UTC"},
+	}
+
+	for _, test := range testTable {
+		if got := test.entry.Summary(); got != test.want {
+			t.Errorf("%s: wanted %q, got: %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(name, []byte("{\"earlier\":true}\n"), 0600); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	file, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	denied := entry
+	denied.Result, denied.Error = ResultDenied, "not allowed"
+	for _, e := range []Entry{entry, denied} {
+		if err := file.Write(context.Background(), e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, _ := os.ReadFile(name)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 || lines[0] != `{"earlier":true}` {
+		t.Fatalf("wanted the entries appended to the file, got: %s", b)
+	}
+	got := Entry{}
+	if err := json.Unmarshal([]byte(lines[2]), &got); err != nil || got != denied {
+		t.Errorf("wanted %+v, got: %+v (%v)", denied, got, err)
+	}
+}
+
+func TestBigQuery(t *testing.T) {
+	var paths []string
+	var rows []map[string]interface{}
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		req := struct {
+			Rows []struct {
+				JSON map[string]interface{} `json:"json"`
+			} `json:"rows"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, row := range req.Rows {
+			rows = append(rows, row.JSON)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if row := rows[len(rows)-1]; row["result"] == ResultFailed {
+			w.Write([]byte(`{"insertErrors": [{"index": 0, "errors": [{"message": "no such field: job"}]}]}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer emulator.Close()
+
+	bq := &BigQuery{
+		Table:   "my-project.deploybot.audit",
+		Options: []option.ClientOption{option.WithEndpoint(emulator.URL), option.WithoutAuthentication()},
+	}
+	if err := bq.Write(context.Background(), entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(paths) != 1 || !strings.HasSuffix(paths[0], "/projects/my-project/datasets/deploybot/tables/audit/insertAll") {
+		t.Errorf("wanted the entry inserted in the table, got: %v", paths)
+	}
+	if len(rows) != 1 || rows[0]["rollout"] != "rel-2-to-staging-0001" || rows[0]["timestamp"] != "2021-06-02T10:00:00Z" {
+		t.Errorf("wanted the entry's fields as columns, got: %v", rows)
+	}
+
+	failed := entry
+	failed.Result = ResultFailed
+	if err := bq.Write(context.Background(), failed); err == nil || !strings.Contains(err.Error(), "no such field: job") {
+		t.Errorf("wanted the insert error, got: %v", err)
+	}
+
+	bq.Table = "audit"
+	if err := bq.Write(context.Background(), entry); err == nil {
+		t.Errorf("wanted an error for a table without project and dataset")
+	}
+}
+
+// failingSink fails every write.
+type failingSink struct {
+	writes int
+}
+
+func (f *failingSink) Write(ctx context.Context, e Entry) error {
+	f.writes++
+	return errors.New("unavailable")
+}
+
+func TestMulti(t *testing.T) {
+	first, second := &failingSink{}, &failingSink{}
+	err := Multi{first, Log, second}.Write(context.Background(), entry)
+	if err == nil || first.writes != 1 || second.writes != 1 {
+		t.Errorf("wanted every sink written to and the errors returned, got: %v, %d, %d", err, first.writes, second.writes)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/api/chat/v1"
+)
+
+// Actions users can take from the buttons of a message. The chatops package
+// carries them out.
+const (
+	ActionPromote  = "promote"
+	ActionRollback = "rollback"
+	ActionRetry    = "retry"
+	ActionCancel   = "cancel"
+	ActionAdvance  = "advance"
+)
+
+// Replier posts a short text under a message the bot sent earlier, e.g. the
+// outcome of an action taken from it. thread is the Slack message timestamp
+// or the Google Chat thread name.
+type Replier interface {
+	Reply(ctx context.Context, channel string, thread string, text string) error
+}
+
+// ChatUpdater replaces the cards of a Google Chat message the bot sent, e.g.
+// to show the state after an action. name is the message's resource name.
+type ChatUpdater interface {
+	UpdateChatMessage(ctx context.Context, name string, msg *chat.Message) error
+}
+
+// ActionValue identifies the resource an action applies to. It is carried
+// by the action's button.
+type ActionValue struct {
+	Action   string `json:"a"`
+	Project  string `json:"p"`
+	Location string `json:"l"`
+	Pipeline string `json:"d"`
+	Release  string `json:"r"`
+	Rollout  string `json:"o,omitempty"`
+	Target   string `json:"t,omitempty"`
+	// Phase and Job name the job to retry. When empty the failed one is
+	// looked up.
+	Phase string `json:"h,omitempty"`
+	Job   string `json:"j,omitempty"`
+}
+
+// NewActionValue returns the value of action on the resource of a
+// notification.
+func NewActionValue(action string, atts map[string]string) ActionValue {
+	return ActionValue{
+		Action:   action,
+		Project:  atts["ProjectNumber"],
+		Location: atts["Location"],
+		Pipeline: atts["DeliveryPipelineId"],
+		Release:  atts["ReleaseId"],
+		Rollout:  atts["RolloutId"],
+		Target:   atts["TargetId"],
+		Phase:    atts["PhaseId"],
+		Job:      atts["JobId"],
+	}
+}
+
+// ParseActionValue reads the value of a button.
+func ParseActionValue(s string) (ActionValue, error) {
+	v := ActionValue{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return v, fmt.Errorf("malformed action value: %v", err)
+	}
+	if v.Action == "" || v.Project == "" || v.Location == "" || v.Pipeline == "" || v.Release == "" {
+		return v, fmt.Errorf("incomplete action value %q", s)
+	}
+	return v, nil
+}
+
+func (v ActionValue) String() string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// ReleaseName is the resource name of the release.
+func (v ActionValue) ReleaseName() string {
+	return fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/%s", v.Project, v.Location, v.Pipeline, v.Release)
+}
+
+// RolloutName is the resource name of the rollout.
+func (v ActionValue) RolloutName() string {
+	return v.ReleaseName() + "/rollouts/" + v.Rollout
+}
+
+// actionButton describes a button for one of the actions.
+type actionButton struct {
+	action  string
+	text    string
+	confirm string
+	// danger styles the button in red where the chat app supports it.
+	danger bool
+}
+
+// actions lists the buttons offered on a notification.
+func actions(atts map[string]string) []actionButton {
+	if atts["ResourceType"] != "Rollout" {
+		return nil
+	}
+
+	// Canary phases before stable succeed on their own, the rollout goes on
+	// once advanced.
+	canary := atts["PhaseId"] != "" && atts["PhaseId"] != "stable"
+
+	var buttons []actionButton
+	if atts["Action"] == "Succeed" && canary {
+		buttons = append(buttons, actionButton{
+			action:  ActionAdvance,
+			text:    "Advance to next phase",
+			confirm: fmt.Sprintf("Advance rollout %s on %s past phase %s?", atts["RolloutId"], atts["TargetId"], atts["PhaseId"]),
+		})
+	}
+	if atts["Action"] == "Succeed" && !canary {
+		buttons = append(buttons, actionButton{
+			action:  ActionPromote,
+			text:    "Promote to next target",
+			confirm: fmt.Sprintf("Promote release %s from %s to the next target?", atts["ReleaseId"], atts["TargetId"]),
+		})
+	}
+	if atts["Action"] == "Start" {
+		buttons = append(buttons, actionButton{
+			action:  ActionCancel,
+			text:    "Cancel rollout",
+			confirm: fmt.Sprintf("Cancel rollout %s of release %s to %s?", atts["RolloutId"], atts["ReleaseId"], atts["TargetId"]),
+			danger:  true,
+		})
+	}
+	if atts["Action"] == "Failure" {
+		buttons = append(buttons, actionButton{
+			action:  ActionRetry,
+			text:    "Retry job",
+			confirm: fmt.Sprintf("Retry the failed job of rollout %s?", atts["RolloutId"]),
+		})
+		buttons = append(buttons, actionButton{
+			action:  ActionRollback,
+			text:    "Roll back",
+			confirm: fmt.Sprintf("Roll %s back to the last release deployed there before %s?", atts["TargetId"], atts["ReleaseId"]),
+			danger:  true,
+		})
+	}
+	return buttons
+}
+
+// slackActions is the "actions" block with the buttons for atts, if any.
+func slackActions(atts map[string]string) []Block {
+	var elements []ButtonBlock
+	for _, b := range actions(atts) {
+		style := ""
+		if b.danger {
+			style = "danger"
+		}
+		elements = append(elements, ButtonBlock{
+			TypeButtonBlock: "button",
+			Text:            ButtonText{TypeButton: "plain_text", Text: b.text},
+			Style:           style,
+			ActionID:        b.action,
+			Value:           NewActionValue(b.action, atts).String(),
+			Confirm: &ConfirmBlock{
+				Title:   &TextBlock{TypeTextBlock: "plain_text", Text: "Are you sure?"},
+				Text:    &TextBlock{TypeTextBlock: "plain_text", Text: b.confirm},
+				Confirm: &TextBlock{TypeTextBlock: "plain_text", Text: "Yes"},
+				Deny:    &TextBlock{TypeTextBlock: "plain_text", Text: "Cancel"},
+			},
+		})
+	}
+	if len(elements) == 0 {
+		return nil
+	}
+	return []Block{{TypeSectionBlock: "actions", Elements: elements}}
+}
+
+// chatActions are the buttons for atts, which open a confirmation dialog.
+func chatActions(atts map[string]string) []*chat.GoogleAppsCardV1Button {
+	var buttons []*chat.GoogleAppsCardV1Button
+	for _, b := range actions(atts) {
+		var color *chat.Color
+		if b.danger {
+			color = failedColor
+		}
+		buttons = append(buttons, &chat.GoogleAppsCardV1Button{
+			Text:  b.text,
+			Color: color,
+			OnClick: &chat.GoogleAppsCardV1OnClick{
+				Action: &chat.GoogleAppsCardV1Action{
+					Function:    b.action,
+					Interaction: "OPEN_DIALOG",
+					Parameters: []*chat.GoogleAppsCardV1ActionParameter{
+						{Key: "value", Value: NewActionValue(b.action, atts).String()},
+						{Key: "confirm", Value: b.confirm},
+					},
+				},
+			},
+		})
+	}
+	return buttons
+}
+
+// withChatActions adds the buttons for atts to the button list of a Cards v2
+// message. Cards v1 messages are left as they are.
+func withChatActions(msg *chat.Message, atts map[string]string) *chat.Message {
+	buttons := chatActions(atts)
+	if len(buttons) == 0 || len(msg.CardsV2) == 0 {
+		return msg
+	}
+
+	sections := msg.CardsV2[0].Card.Sections
+	list := sections[len(sections)-1].Widgets[0].ButtonList
+	list.Buttons = append(list.Buttons, buttons...)
+	return msg
+}
@@ -16,6 +16,8 @@ limitations under the License.
 
 package bot
 
+import "context"
+
 // Bot should format the message the way it sees fit
 // using the message map to identify the type of message
 // and to organise key info into the best layout for the different
@@ -23,3 +25,19 @@ package bot
 type Bot interface {
 	SendMessage(channel string, message map[string]string) (string, error)
 }
+
+// ContextBot is a Bot which also takes ctx, carrying the deadline, trace and
+// log labels of the notification being handled. The adapters of this package
+// implement it, other ones may.
+type ContextBot interface {
+	Bot
+	SendMessageContext(ctx context.Context, channel string, message map[string]string) (string, error)
+}
+
+// Send posts message with b, handing it ctx if b is a ContextBot.
+func Send(ctx context.Context, b Bot, channel string, message map[string]string) (string, error) {
+	if cb, ok := b.(ContextBot); ok {
+		return cb.SendMessageContext(ctx, channel, message)
+	}
+	return b.SendMessage(channel, message)
+}
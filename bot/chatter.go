@@ -18,18 +18,83 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
 
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/chat/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+const chatScope = "https://www.googleapis.com/auth/chat.bot"
+
+func init() {
+	Register("google", newGChatAdapter)
+}
+
+// GChatAdapter posts messages as a Google Chat app. BotToken is the app's
+// Service Account Key JSON data; when empty Application Default Credentials
+// are used instead, e.g. the Cloud Function's own identity.
 type GChatAdapter struct {
-	BotToken    string
+	BotToken string
+	// URLEndpoint overrides the Google Chat API endpoint, e.g. in tests.
+	// Requests to it are not authenticated.
 	URLEndpoint string
+	// HTTPClient, when set, is used as is to talk to Google Chat so it must
+	// take care of authentication itself, unless URLEndpoint is also set.
+	HTTPClient *http.Client
+	// CardsV1 posts the deprecated Cards v1 messages instead of Cards v2.
+	CardsV1 bool
+	// Actions adds buttons to act on the rollouts, see the chatops package.
+	// They need Cards v2.
+	Actions bool
+
+	// The Chat service is built on first use and then reused by every
+	// message the adapter sends.
+	mu      sync.Mutex
+	service *chat.Service
+}
+
+// newGChatAdapter needs a space, the token can be left empty to use
+// Application Default Credentials.
+func newGChatAdapter(s Settings) (Bot, error) {
+	var errs []error
+	if s.Channel == "" {
+		errs = append(errs, errors.New("channel is required for google"))
+	}
+	if err := ValidateGChatCredentials(s.Token); err != nil {
+		errs = append(errs, fmt.Errorf("token is not a valid Service Account Key: %v", err))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &GChatAdapter{BotToken: s.Token, CardsV1: s.CardsV1, Actions: s.Actions}, nil
+}
+
+// ValidateGChatCredentials checks that token is usable Service Account Key JSON
+// data, so a bad TOKEN is spotted at startup rather than on the first message.
+// An empty token is valid as Application Default Credentials will be used.
+func ValidateGChatCredentials(token string) error {
+	if token == "" {
+		return nil
+	}
+	_, err := google.CredentialsFromJSON(context.Background(), []byte(token), chatScope)
+	if err != nil {
+		return fmt.Errorf("could not parse credentials: %v", err)
+	}
+	return nil
 }
 
 func (chatter *GChatAdapter) SendMessage(channel string, message map[string]string) (string, error) {
+	return chatter.SendMessageContext(context.Background(), channel, message)
+}
+
+func (chatter *GChatAdapter) SendMessageContext(ctx context.Context, channel string, message map[string]string) (string, error) {
 
 	resource, ok := message["ResourceType"]
 	if !ok {
@@ -39,37 +104,106 @@ func (chatter *GChatAdapter) SendMessage(channel string, message map[string]stri
 	msg := &chat.Message{Text: "some other resource"}
 
 	if resource == "Release" || resource == "Rollout" {
-		msg = GetChatMsg(message)
+		_, span := startRender(ctx, message)
+		msg = chatMsg(message, chatter.CardsV1)
+		if chatter.Actions {
+			msg = withChatActions(msg, message)
+		}
+		span.End()
 	} else {
-		return "", fmt.Errorf("resourceType not a Release or a Rollout")
+		return "", ErrUnsupportedResource
+	}
+
+	chatService, err := chatter.chatService()
+	if err != nil {
+		return "", err
 	}
 
-	ctx := context.Background()
-	opts := option.WithCredentialsJSON([]byte([]byte(chatter.BotToken)))
-	optsScope := option.WithScopes("https://www.googleapis.com/auth/chat.bot")
+	space := fmt.Sprintf("spaces/%s", channel)
+	slog.DebugContext(ctx, "posting to Google Chat", "space", space)
+	created := chatService.Spaces.Messages.Create(space, msg)
+	callCtx, span := startCall(ctx, "google chat spaces.messages.create", chatService.BasePath)
+	messageCreated, err := created.Context(callCtx).Do()
+	tracing.End(span, err)
 
-	var chatService *chat.Service
-	var err error
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) {
+			return "", statusError(apiErr.Code, fmt.Errorf("request was not ok: %w", err))
+		}
+		return "", transportError(fmt.Errorf("request was not ok: %w", err))
+	}
 
-	// To aid in testing
-	if chatter.URLEndpoint != "" {
-		testURL := option.WithEndpoint(chatter.URLEndpoint)
-		chatService, err = chat.NewService(ctx, opts, optsScope, testURL, option.WithoutAuthentication())
-	} else {
-		chatService, err = chat.NewService(ctx, opts, optsScope)
+	return fmt.Sprintf("%v", messageCreated), nil
+}
+
+// Reply posts text in the thread named thread of the space channel.
+func (chatter *GChatAdapter) Reply(ctx context.Context, channel string, thread string, text string) error {
+	chatService, err := chatter.chatService()
+	if err != nil {
+		return err
 	}
 
+	msg := &chat.Message{Text: text, Thread: &chat.Thread{Name: thread}}
+	created := chatService.Spaces.Messages.Create(fmt.Sprintf("spaces/%s", channel), msg).
+		MessageReplyOption("REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+
+	callCtx, span := startCall(ctx, "google chat spaces.messages.create", chatService.BasePath)
+	_, err = created.Context(callCtx).Do()
+	tracing.End(span, err)
 	if err != nil {
-		return "", fmt.Errorf("could not create service: %v", err)
+		return fmt.Errorf("could not reply: %w", err)
 	}
+	return nil
+}
 
-	space := fmt.Sprintf("spaces/%s", channel)
-	created := chatService.Spaces.Messages.Create(space, msg)
-	messageCreated, err := created.Do()
+// UpdateChatMessage replaces the cards of the message with the resource name
+// name by those of msg.
+func (chatter *GChatAdapter) UpdateChatMessage(ctx context.Context, name string, msg *chat.Message) error {
+	chatService, err := chatter.chatService()
+	if err != nil {
+		return err
+	}
 
+	callCtx, span := startCall(ctx, "google chat spaces.messages.patch", chatService.BasePath)
+	_, err = chatService.Spaces.Messages.Patch(name, msg).UpdateMask("cardsV2").Context(callCtx).Do()
+	tracing.End(span, err)
 	if err != nil {
-		return "", fmt.Errorf("request was not ok: %v", err)
+		return fmt.Errorf("could not update message: %w", err)
 	}
+	return nil
+}
 
-	return fmt.Sprintf("%v", messageCreated), nil
+// chatService returns the adapter's Chat service, creating it if needed.
+// It is safe for concurrent use.
+func (chatter *GChatAdapter) chatService() (*chat.Service, error) {
+	chatter.mu.Lock()
+	defer chatter.mu.Unlock()
+
+	if chatter.service != nil {
+		return chatter.service, nil
+	}
+
+	clientOpts := []option.ClientOption{option.WithScopes(chatScope)}
+	if chatter.BotToken != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsJSON([]byte(chatter.BotToken)))
+	}
+
+	// To aid in testing
+	if chatter.URLEndpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(chatter.URLEndpoint), option.WithoutAuthentication())
+	}
+	if chatter.HTTPClient != nil {
+		clientOpts = append(clientOpts, option.WithHTTPClient(chatter.HTTPClient))
+	}
+
+	// The service outlives any single message so it gets its own context.
+	chatService, err := chat.NewService(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create service: %v", err)
+	}
+
+	slog.Debug("created Google Chat service", "endpoint", chatter.URLEndpoint)
+	chatter.service = chatService
+	return chatService, nil
 }
@@ -24,6 +24,7 @@ import (
 
 // GetChatMsg returns a struct representing a Message formatted with Google Chat "Cards"
 // with information about a Release or Rollout depending on the ResourceType key in atts.
+// Cards v1 are deprecated, GetChatMsgV2 is used unless the adapter opts in to them.
 func GetChatMsg(atts map[string]string) *chat.Message {
 	consoleUrl := fmt.Sprintf("https://console.cloud.google.com/deploy/delivery-pipelines/%s/%s/", atts["Location"], atts["DeliveryPipelineId"])
 	target := fmt.Sprintf("%stargets/%s?project=%s", consoleUrl, atts["TargetId"], atts["ProjectNumber"])
@@ -77,6 +78,14 @@ func GetChatMsg(atts map[string]string) *chat.Message {
 				},
 			},
 		}
+		if atts["PhaseId"] != "" {
+			moreWidgets = append(moreWidgets, &chat.WidgetMarkup{
+				KeyValue: &chat.KeyValue{
+					TopLabel: "Phase",
+					Content:  phaseProgress(atts["PhaseId"]),
+				},
+			})
+		}
 		section.Widgets = append(moreWidgets, section.Widgets...)
 	}
 
@@ -100,6 +109,19 @@ func GetChatMsg(atts map[string]string) *chat.Message {
 	}
 
 	sections = append(sections, section)
+	if details := releaseDetails(atts); len(details) > 0 {
+		detailsSection := &chat.Section{Header: "Release details"}
+		for _, d := range details {
+			detailsSection.Widgets = append(detailsSection.Widgets, &chat.WidgetMarkup{
+				KeyValue: &chat.KeyValue{
+					TopLabel:         d.label,
+					Content:          chatDetailText(d),
+					ContentMultiline: true,
+				},
+			})
+		}
+		sections = append(sections, detailsSection)
+	}
 	sections = append(sections, buttonSection)
 
 	card := &chat.Card{
@@ -0,0 +1,231 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"google.golang.org/api/chat/v1"
+)
+
+// Colours of the status chip, by outcome.
+var (
+	startedColor   = &chat.Color{Red: 0.10, Green: 0.45, Blue: 0.91}
+	succeededColor = &chat.Color{Red: 0.12, Green: 0.56, Blue: 0.24}
+	failedColor    = &chat.Color{Red: 0.85, Green: 0.19, Blue: 0.15}
+)
+
+// GetChatMsgV2 returns a struct representing a Message formatted with Google Chat
+// "Cards v2" with information about a Release or Rollout depending on the
+// ResourceType key in atts.
+func GetChatMsgV2(atts map[string]string) *chat.Message {
+	consoleUrl := fmt.Sprintf("https://console.cloud.google.com/deploy/delivery-pipelines/%s/%s/", atts["Location"], atts["DeliveryPipelineId"])
+	deliveryPipe := fmt.Sprintf("%s?project=%s", consoleUrl, atts["ProjectNumber"])
+	target := fmt.Sprintf("%stargets/%s?project=%s", consoleUrl, atts["TargetId"], atts["ProjectNumber"])
+	release := fmt.Sprintf("%sreleases/%s/rollouts?project=%s", consoleUrl, atts["ReleaseId"], atts["ProjectNumber"])
+
+	link := release
+	if atts["ResourceType"] == "Rollout" {
+		link = target
+	}
+
+	statusSection := &chat.GoogleAppsCardV1Section{
+		Widgets: []*chat.GoogleAppsCardV1Widget{
+			{
+				DecoratedText: &chat.GoogleAppsCardV1DecoratedText{
+					TopLabel:  "Status",
+					Text:      atts["Action"],
+					StartIcon: materialIcon(statusIcon(atts)),
+					Button:    statusChip(atts, link),
+				},
+			},
+		},
+	}
+
+	// Release and Rollout on the left, where they were deployed on the right.
+	left := []*chat.GoogleAppsCardV1Widgets{
+		decoratedText("Release", atts["ReleaseId"], "inventory_2"),
+	}
+	right := []*chat.GoogleAppsCardV1Widgets{
+		decoratedText("Pipeline", atts["DeliveryPipelineId"], "account_tree"),
+	}
+	buttons := []*chat.GoogleAppsCardV1Button{
+		linkButton("View Release", release),
+	}
+
+	// Add a few fields and links if this is a Rollout.
+	if atts["ResourceType"] == "Rollout" {
+		left = append(left, decoratedText("Rollout", atts["RolloutId"], "rocket_launch"))
+		if atts["PhaseId"] != "" {
+			left = append(left, decoratedText("Phase", phaseProgress(atts["PhaseId"]), "percent"))
+		}
+		right = append([]*chat.GoogleAppsCardV1Widgets{decoratedText("Target", atts["TargetId"], "flag")}, right...)
+		buttons = append(buttons, linkButton("View Target", target))
+	}
+	buttons = append(buttons, linkButton("View Pipeline", deliveryPipe))
+
+	detailsSection := &chat.GoogleAppsCardV1Section{
+		Widgets: []*chat.GoogleAppsCardV1Widget{
+			{
+				Columns: &chat.GoogleAppsCardV1Columns{
+					ColumnItems: []*chat.GoogleAppsCardV1Column{
+						{Widgets: left},
+						{Widgets: right},
+					},
+				},
+			},
+		},
+	}
+
+	buttonSection := &chat.GoogleAppsCardV1Section{
+		Widgets: []*chat.GoogleAppsCardV1Widget{
+			{
+				ButtonList: &chat.GoogleAppsCardV1ButtonList{
+					Buttons: buttons,
+				},
+			},
+		},
+	}
+
+	card := &chat.GoogleAppsCardV1Card{
+		Header: &chat.GoogleAppsCardV1CardHeader{
+			Title:    headerHelper(atts),
+			Subtitle: atts["DeliveryPipelineId"],
+		},
+		Sections: []*chat.GoogleAppsCardV1Section{statusSection, detailsSection},
+	}
+	if section := chatDetailsV2(atts); section != nil {
+		card.Sections = append(card.Sections, section)
+	}
+	// The buttons come last, where the actions are added.
+	card.Sections = append(card.Sections, buttonSection)
+
+	return &chat.Message{
+		CardsV2: []*chat.CardWithId{
+			{
+				CardId: "deploybot",
+				Card:   card,
+			},
+		},
+	}
+}
+
+// chatDetailsV2 is a collapsible section with the release details of an
+// enriched notification, nil without any.
+func chatDetailsV2(atts map[string]string) *chat.GoogleAppsCardV1Section {
+	details := releaseDetails(atts)
+	if len(details) == 0 {
+		return nil
+	}
+
+	section := &chat.GoogleAppsCardV1Section{Header: "Release details"}
+	// Beyond the images, Skaffold version and creator, details are shown on
+	// demand.
+	if len(details) > 3 {
+		section.Collapsible, section.UncollapsibleWidgetsCount = true, 3
+	}
+	for _, d := range details {
+		section.Widgets = append(section.Widgets, &chat.GoogleAppsCardV1Widget{
+			DecoratedText: &chat.GoogleAppsCardV1DecoratedText{
+				TopLabel:  d.label,
+				Text:      chatDetailText(d),
+				StartIcon: materialIcon(d.icon),
+				WrapText:  true,
+			},
+		})
+	}
+	return section
+}
+
+// chatDetailText is the HTML shown for d, in Cards v1 and v2, which can't
+// show code.
+func chatDetailText(d detail) string {
+	values := make([]string, len(d.values))
+	for i, value := range d.values {
+		value = html.EscapeString(value)
+		if d.link {
+			value = fmt.Sprintf("<a href=\"%s\">%s</a>", value, value)
+		}
+		values[i] = value
+	}
+	return strings.Join(values, "<br>")
+}
+
+// statusChip is a button coloured by the outcome which opens the resource.
+func statusChip(atts map[string]string, link string) *chat.GoogleAppsCardV1Button {
+	color := startedColor
+	if atts["Action"] == "Succeed" {
+		color = succeededColor
+	} else if atts["Action"] != "Start" {
+		color = failedColor
+	}
+
+	return &chat.GoogleAppsCardV1Button{
+		Text:    atts["ResourceType"],
+		Type:    "FILLED",
+		Color:   color,
+		OnClick: openLink(link),
+	}
+}
+
+func statusIcon(atts map[string]string) string {
+	if atts["Action"] == "Start" {
+		return "pending"
+	} else if atts["Action"] == "Succeed" {
+		return "check_circle"
+	}
+	return "error"
+}
+
+func decoratedText(label string, text string, icon string) *chat.GoogleAppsCardV1Widgets {
+	return &chat.GoogleAppsCardV1Widgets{
+		DecoratedText: &chat.GoogleAppsCardV1DecoratedText{
+			TopLabel:  label,
+			Text:      text,
+			StartIcon: materialIcon(icon),
+		},
+	}
+}
+
+func linkButton(text string, link string) *chat.GoogleAppsCardV1Button {
+	return &chat.GoogleAppsCardV1Button{
+		Text:    text,
+		OnClick: openLink(link),
+	}
+}
+
+func materialIcon(name string) *chat.GoogleAppsCardV1Icon {
+	return &chat.GoogleAppsCardV1Icon{
+		MaterialIcon: &chat.GoogleAppsCardV1MaterialIcon{Name: name},
+	}
+}
+
+func openLink(link string) *chat.GoogleAppsCardV1OnClick {
+	return &chat.GoogleAppsCardV1OnClick{
+		OpenLink: &chat.GoogleAppsCardV1OpenLink{Url: link},
+	}
+}
+
+// chatMsg returns the Cards v2 message unless v1 asks for the legacy cards.
+func chatMsg(atts map[string]string, v1 bool) *chat.Message {
+	if v1 {
+		return GetChatMsg(atts)
+	}
+	return GetChatMsgV2(atts)
+}
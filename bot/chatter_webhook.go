@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"google.golang.org/api/chat/v1"
+)
+
+func init() {
+	Register("google-webhook", newGChatWebhookAdapter)
+}
+
+// GChatWebhookAdapter posts the same cards as GChatAdapter to a Google Chat
+// space's incoming webhook, so no Chat app or Service Account is needed.
+// The webhook URL identifies the space, so the channel is ignored.
+type GChatWebhookAdapter struct {
+	WebhookURL string
+	// ThreadByRelease replies to a thread per pipeline and release instead of
+	// starting a new thread for every message.
+	ThreadByRelease bool
+	// CardsV1 posts the deprecated Cards v1 messages instead of Cards v2.
+	CardsV1 bool
+	// HTTPClient is used to call the webhook, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// newGChatWebhookAdapter takes the space's webhook URL as the token.
+func newGChatWebhookAdapter(s Settings) (Bot, error) {
+	if !strings.HasPrefix(s.Token, "https://") {
+		return nil, errors.New("token should be the space's webhook URL for google-webhook")
+	}
+	return &GChatWebhookAdapter{WebhookURL: s.Token, ThreadByRelease: s.ThreadByRelease, CardsV1: s.CardsV1}, nil
+}
+
+func (hook *GChatWebhookAdapter) SendMessage(channel string, message map[string]string) (string, error) {
+	return hook.SendMessageContext(context.Background(), channel, message)
+}
+
+func (hook *GChatWebhookAdapter) SendMessageContext(ctx context.Context, channel string, message map[string]string) (result string, err error) {
+
+	resource, ok := message["ResourceType"]
+	if !ok {
+		return "", fmt.Errorf("could not find ResourceType key")
+	}
+
+	if resource != "Release" && resource != "Rollout" {
+		return "", ErrUnsupportedResource
+	}
+
+	endpoint, err := hook.endpoint(message)
+	if err != nil {
+		return "", err
+	}
+
+	_, span := startRender(ctx, message)
+	marshalled, err := json.Marshal(chatMsg(message, hook.CardsV1))
+	span.End()
+	if err != nil {
+		return "", fmt.Errorf("while marshalling chat.Message we got: %s", err)
+	}
+
+	slog.DebugContext(ctx, "posting to Google Chat webhook", "threadByRelease", hook.ThreadByRelease)
+	ctx, span = startCall(ctx, "google chat webhook", endpoint)
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(marshalled))
+	if err != nil {
+		return "", fmt.Errorf("failed calling NewRequestWithContext: %v", err)
+	}
+	req.Header.Set("Content-type", "application/json; charset=utf-8")
+
+	client := http.DefaultClient
+	if hook.HTTPClient != nil {
+		client = hook.HTTPClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", transportError(fmt.Errorf("couldnt do request: %w", err))
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp.StatusCode, fmt.Errorf("request was not ok: %v", resp.StatusCode))
+	}
+
+	created := &chat.Message{}
+	if err := json.NewDecoder(resp.Body).Decode(created); err != nil {
+		return "", fmt.Errorf("could not decode webhook response: %v", err)
+	}
+
+	return fmt.Sprintf("message: %s thread: %s", created.Name, threadName(created)), nil
+}
+
+// endpoint returns the webhook URL with the threading query parameters set.
+func (hook *GChatWebhookAdapter) endpoint(message map[string]string) (string, error) {
+	u, err := url.Parse(hook.WebhookURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook URL: %v", err)
+	}
+
+	if hook.ThreadByRelease {
+		q := u.Query()
+		q.Set("threadKey", fmt.Sprintf("%s-%s", message["DeliveryPipelineId"], message["ReleaseId"]))
+		q.Set("messageReplyOption", "REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD")
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String(), nil
+}
+
+func threadName(msg *chat.Message) string {
+	if msg.Thread == nil {
+		return ""
+	}
+	return msg.Thread.Name
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrUnsupportedResource is returned for notifications that are neither about
+// a Release nor a Rollout. Posting them again will never succeed.
+var ErrUnsupportedResource = errors.New("resourceType not a Release or a Rollout")
+
+// DeliveryError is returned by the adapters when a message could not be posted
+// to the chat app. Retryable tells the caller whether trying again later
+// (e.g. by letting Pub/Sub redeliver the event) might succeed.
+type DeliveryError struct {
+	StatusCode int
+	Retryable  bool
+	Err        error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("delivery failed with status %d: %v", e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("delivery failed: %v", e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is a transient failure: a network error,
+// a 5xx or a 429 from the chat app. Everything else, such as an unsupported
+// resource or a 4xx caused by bad credentials, is considered permanent.
+func IsRetryable(err error) bool {
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return de.Retryable
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// statusError classifies a non successful HTTP response from the chat app.
+func statusError(code int, err error) error {
+	return &DeliveryError{
+		StatusCode: code,
+		Retryable:  code == http.StatusTooManyRequests || code >= http.StatusInternalServerError,
+		Err:        err,
+	}
+}
+
+// transportError wraps a failure to reach the chat app at all.
+func transportError(err error) error {
+	return &DeliveryError{Retryable: true, Err: err}
+}
@@ -16,7 +16,11 @@ limitations under the License.
 
 package bot
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func headerHelper(atts map[string]string) string {
 
@@ -33,3 +37,64 @@ func headerHelper(atts map[string]string) string {
 	return fmt.Sprintf("👋 Hello, I %s a %s !", action, atts["ResourceType"])
 
 }
+
+// phaseProgress shows how far a canary rollout has gone from its phase ID,
+// which Cloud Deploy names canary-25 for 25% of the traffic, then stable.
+// Custom phases are shown as they are.
+func phaseProgress(phase string) string {
+	percent := 100
+	if phase != "stable" {
+		n, err := strconv.Atoi(strings.TrimPrefix(phase, "canary-"))
+		if err != nil || n < 0 || n > 100 {
+			return phase
+		}
+		percent = n
+	}
+
+	bar := strings.Repeat("▰", percent/10) + strings.Repeat("▱", 10-percent/10)
+	if phase == "stable" {
+		return fmt.Sprintf("stable %s 100%%", bar)
+	}
+	return fmt.Sprintf("%s %s %d%% → stable", phase, bar, percent)
+}
+
+// detail is something about the release of an enriched notification, see
+// gcpclouddeploy.Enricher.
+type detail struct {
+	label  string
+	values []string
+	icon   string
+	// code values are shown in a fixed-width font where possible, link ones
+	// are URLs.
+	code bool
+	link bool
+}
+
+// releaseDetails lists the details the notification was enriched with: the
+// images, the Skaffold version, who created the release and its annotations.
+func releaseDetails(atts map[string]string) []detail {
+	var details []detail
+	if atts["Images"] != "" {
+		details = append(details, detail{label: "Images", values: strings.Split(atts["Images"], "\n"), icon: "deployed_code", code: true})
+	}
+	if atts["SkaffoldVersion"] != "" {
+		details = append(details, detail{label: "Skaffold", values: []string{atts["SkaffoldVersion"]}, icon: "build", code: true})
+	}
+	if atts["CreatedBy"] != "" {
+		details = append(details, detail{label: "Created by", values: []string{atts["CreatedBy"]}, icon: "person"})
+	}
+
+	for _, line := range strings.Split(atts["Annotations"], "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		link := strings.HasPrefix(value, "https://") || strings.HasPrefix(value, "http://")
+		icon := "sell"
+		if link {
+			icon = "link"
+		}
+		details = append(details, detail{label: key, values: []string{value}, icon: icon, link: link})
+	}
+	return details
+}
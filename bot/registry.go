@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings are handed to a Factory to build its Bot.
+type Settings struct {
+	// Token is the adapter's credentials, e.g. a bot token, Service Account
+	// Key JSON data or a webhook URL.
+	Token string
+	// Channel is where messages go, e.g. a Slack channel or a Chat space.
+	Channel string
+	// WebhookURL is an incoming webhook to post to instead of using Token.
+	WebhookURL string
+	// ThreadByRelease groups the messages about a release in one thread.
+	ThreadByRelease bool
+	// CardsV1 asks Google Chat adapters for the deprecated Cards v1.
+	CardsV1 bool
+	// Actions adds buttons to act on the rollouts, e.g. to promote them.
+	Actions bool
+	// Options holds settings specific to an adapter.
+	Options map[string]string
+}
+
+// Factory checks the settings an adapter needs and builds it. It should report
+// every problem with the settings at once, e.g. using errors.Join.
+type Factory func(s Settings) (Bot, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes an adapter available under name, e.g. for the CHATAPP
+// setting. Adapters usually register themselves in an init function, so a
+// chat app living in another module only has to be imported. Register panics
+// if name is already taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("bot: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("bot: Register called twice for adapter " + name)
+	}
+	registry[name] = factory
+}
+
+// unregister removes the adapter registered under name, for tests.
+func unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, name)
+}
+
+// New builds the adapter registered under name.
+func New(name string, s Settings) (Bot, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown chat app %q, should be one of: %s", name, strings.Join(Adapters(), ", "))
+	}
+	return factory(s)
+}
+
+// Adapters lists the names of the registered adapters, sorted.
+func Adapters() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -16,7 +16,13 @@ limitations under the License.
 
 package bot
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
+
+// maxSlackFields is how many fields Slack shows in a section.
+const maxSlackFields = 10
 
 type SlackMessageWrapper struct {
 	Token   string  `json:"token,omitempty"`
@@ -24,6 +30,13 @@ type SlackMessageWrapper struct {
 	Unfurl  bool    `json:"unfurl_links,omitempty"`
 	Text    string  `json:"text,omitempty"`
 	Blocks  []Block `json:"blocks,omitempty"`
+	// ThreadTS posts the message as a reply to the message with this ts.
+	ThreadTS string `json:"thread_ts,omitempty"`
+	// ResponseType is "ephemeral" or "in_channel" when answering commands.
+	ResponseType string `json:"response_type,omitempty"`
+	// ReplaceOriginal replaces the message answered, when posting to a
+	// response_url.
+	ReplaceOriginal bool `json:"replace_original,omitempty"`
 }
 
 type Block struct {
@@ -40,10 +53,20 @@ type TextBlock struct {
 }
 
 type ButtonBlock struct {
-	TypeButtonBlock string     `json:"type,omitempty"`
-	Text            ButtonText `json:"text,omitempty"`
-	Style           string     `json:"style,omitempty"`
-	Value           string     `json:"value,omitempty"`
+	TypeButtonBlock string        `json:"type,omitempty"`
+	Text            ButtonText    `json:"text,omitempty"`
+	Style           string        `json:"style,omitempty"`
+	Value           string        `json:"value,omitempty"`
+	ActionID        string        `json:"action_id,omitempty"`
+	Confirm         *ConfirmBlock `json:"confirm,omitempty"`
+}
+
+// ConfirmBlock is the dialog Slack shows before acting on a button click.
+type ConfirmBlock struct {
+	Title   *TextBlock `json:"title,omitempty"`
+	Text    *TextBlock `json:"text,omitempty"`
+	Confirm *TextBlock `json:"confirm,omitempty"`
+	Deny    *TextBlock `json:"deny,omitempty"`
 }
 
 type ButtonText struct {
@@ -68,7 +91,7 @@ func GetSlackMsgRelease(atts map[string]string) []Block {
 		statusEmoji = "⚠️"
 	}
 
-	return []Block{
+	blocks := []Block{
 		{
 			TypeSectionBlock: "header",
 			Text: &TextBlock{
@@ -92,6 +115,7 @@ func GetSlackMsgRelease(atts map[string]string) []Block {
 			},
 		},
 	}
+	return append(blocks, slackDetails(atts)...)
 }
 
 // GetSlackMsgRelease returns a struct representing a "Block Kit" formatted Slack message
@@ -111,7 +135,12 @@ func GetSlackMsgRollout(atts map[string]string) []Block {
 		statusEmoji = "⚠️"
 	}
 
-	return []Block{
+	rollout := fmt.Sprintf("*Rollout: <%s|%s>* \n*Target:* <%s|%s>", release, atts["RolloutId"], target, atts["TargetId"])
+	if atts["PhaseId"] != "" {
+		rollout += fmt.Sprintf(" \n*Phase:* %s", phaseProgress(atts["PhaseId"]))
+	}
+
+	blocks := []Block{
 		{
 			TypeSectionBlock: "header",
 			Text: &TextBlock{
@@ -124,7 +153,7 @@ func GetSlackMsgRollout(atts map[string]string) []Block {
 			TypeSectionBlock: "section",
 			Text: &TextBlock{
 				TypeTextBlock: "mrkdwn",
-				Text:          fmt.Sprintf("*Rollout: <%s|%s>* \n*Target:* <%s|%s>", release, atts["RolloutId"], target, atts["TargetId"]),
+				Text:          rollout,
 			},
 		},
 		{
@@ -135,6 +164,44 @@ func GetSlackMsgRollout(atts map[string]string) []Block {
 			},
 		},
 	}
+	return append(blocks, slackDetails(atts)...)
+}
+
+// slackDetails is a section with the release details of an enriched
+// notification, if any.
+func slackDetails(atts map[string]string) []Block {
+	details := releaseDetails(atts)
+	if len(details) == 0 {
+		return nil
+	}
+	if len(details) > maxSlackFields {
+		details = details[:maxSlackFields]
+	}
+
+	block := Block{TypeSectionBlock: "section"}
+	for _, d := range details {
+		values := make([]string, len(d.values))
+		for i, value := range d.values {
+			value = slackEscape(value)
+			if d.code {
+				value = "`" + value + "`"
+			} else if d.link {
+				value = fmt.Sprintf("<%s|%s>", value, value)
+			}
+			values[i] = value
+		}
+		block.Fields = append(block.Fields, TextBlock{
+			TypeTextBlock: "mrkdwn",
+			Text:          fmt.Sprintf("*%s:*\n%s", slackEscape(d.label), strings.Join(values, "\n")),
+		})
+	}
+	return []Block{block}
+}
+
+// slackEscape escapes the characters Slack's mrkdwn uses for links and
+// mentions.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
 }
 
 func GetSlackMsg(atts map[string]string) []Block {
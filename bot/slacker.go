@@ -20,78 +20,244 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
 )
 
 const slackApiPostMessage = "https://slack.com/api/chat.postMessage"
 
+func init() {
+	Register("slack", newSlackAdapter)
+}
+
 type SlackAdapter struct {
-	BotToken    string
+	BotToken string
+	// URLEndpoint overrides Slack's chat.postMessage URL, e.g. in tests.
 	URLEndpoint string
+	// WebhookURL, when set, posts to this incoming webhook instead of calling
+	// chat.postMessage with BotToken. The webhook decides the channel.
+	WebhookURL string
+	// HTTPClient is used to talk to Slack, http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// Actions adds buttons to act on the rollouts, see the chatops package.
+	Actions bool
+}
+
+// newSlackAdapter posts with a bot token, or to an incoming webhook given
+// either on its own or in place of the token.
+func newSlackAdapter(s Settings) (Bot, error) {
+	webhook := s.WebhookURL
+	if webhook == "" && IsSlackWebhook(s.Token) {
+		webhook = s.Token
+	}
+	if webhook != "" {
+		return &SlackAdapter{WebhookURL: webhook, Actions: s.Actions}, nil
+	}
+
+	var errs []error
+	if s.Token == "" {
+		errs = append(errs, errors.New("token is required for slack, unless using a webhook"))
+	}
+	if s.Channel == "" {
+		errs = append(errs, errors.New("channel is required for slack, unless using a webhook"))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &SlackAdapter{BotToken: s.Token, Actions: s.Actions}, nil
+}
+
+// SlackResponse holds the fields of a chat.postMessage response the bot cares
+// about. TS and Channel identify the posted message, e.g. to reply in thread.
+type SlackResponse struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	TS       string `json:"ts,omitempty"`
+	Metadata struct {
+		Messages []string `json:"messages,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+	} `json:"response_metadata,omitempty"`
+}
+
+// SlackAPIError is returned when Slack answers with "ok": false.
+// Code is Slack's error code, e.g. "channel_not_found".
+type SlackAPIError struct {
+	Code     string
+	Warnings []string
+}
+
+func (e *SlackAPIError) Error() string {
+	if len(e.Warnings) > 0 {
+		return fmt.Sprintf("slack error: %s (warnings: %s)", e.Code, strings.Join(e.Warnings, ", "))
+	}
+	return fmt.Sprintf("slack error: %s", e.Code)
+}
+
+// slackRetryableErrors are the "ok": false codes worth trying again later.
+var slackRetryableErrors = map[string]bool{
+	"ratelimited":         true,
+	"internal_error":      true,
+	"fatal_error":         true,
+	"request_timeout":     true,
+	"service_unavailable": true,
 }
 
 func (slacker *SlackAdapter) SendMessage(channel string, message map[string]string) (string, error) {
+	return slacker.SendMessageContext(context.Background(), channel, message)
+}
+
+func (slacker *SlackAdapter) SendMessageContext(ctx context.Context, channel string, message map[string]string) (string, error) {
+
+	resp, err := slacker.PostMessage(ctx, channel, message)
+	if err != nil {
+		return "", err
+	}
+	// Webhooks don't say which message was posted.
+	if slacker.WebhookURL != "" {
+		return "", nil
+	}
+
+	return fmt.Sprintf("channel: %s ts: %s", resp.Channel, resp.TS), nil
+}
+
+// PostMessage does the same as SendMessage but returns Slack's response, so
+// callers can later refer to the message that was posted. Incoming webhooks
+// don't say which message was posted, so TS and Channel are empty for them.
+func (slacker *SlackAdapter) PostMessage(ctx context.Context, channel string, message map[string]string) (*SlackResponse, error) {
 
 	resource, ok := message["ResourceType"]
 	if !ok {
-		return "", fmt.Errorf("could not find ResourceType key")
+		return nil, fmt.Errorf("could not find ResourceType key")
 	}
 
 	var msgBlocks []Block
 
 	if resource == "Release" || resource == "Rollout" {
+		_, span := startRender(ctx, message)
 		msgBlocks = GetSlackMsg(message)
+		if slacker.Actions {
+			msgBlocks = append(msgBlocks, slackActions(message)...)
+		}
+		span.End()
 	} else {
-		return "", fmt.Errorf("resourceType not a Release or a Rollout")
+		return nil, ErrUnsupportedResource
 	}
 
-	// To aid in testing
-	if slacker.URLEndpoint != "" {
-		return chatPostMessage(slacker.BotToken, channel, msgBlocks, slacker.URLEndpoint)
+	client := slacker.client()
+
+	if slacker.WebhookURL != "" {
+		slog.DebugContext(ctx, "posting to Slack webhook")
+		return webhookPostMessage(ctx, client, msgBlocks, slacker.WebhookURL)
 	}
 
-	return chatPostMessage(slacker.BotToken, channel, msgBlocks, slackApiPostMessage)
+	slog.DebugContext(ctx, "posting to Slack", "channel", channel)
+	resp, err := chatPostMessage(ctx, client, slacker.BotToken, channel, msgBlocks, slacker.endpoint())
+	if err == nil && (resp.Warning != "" || len(resp.Metadata.Warnings) > 0) {
+		slog.WarnContext(ctx, "Slack accepted the message with warnings", "warning", resp.Warning, "warnings", resp.Metadata.Warnings)
+	}
+	return resp, err
 }
 
-func chatPostMessage(token string, channel string, blockMessage []Block, url string) (string, error) {
+// Reply posts text in the thread of the message with timestamp thread.
+func (slacker *SlackAdapter) Reply(ctx context.Context, channel string, thread string, text string) error {
+	if slacker.WebhookURL != "" {
+		return errors.New("can't reply in threads with a webhook")
+	}
+
+	theMsg := SlackMessageWrapper{
+		Token:    slacker.BotToken,
+		Channel:  channel,
+		Text:     text,
+		ThreadTS: thread,
+	}
+	_, err := slackPost(ctx, slacker.client(), slacker.BotToken, theMsg, slacker.endpoint())
+	return err
+}
+
+func (slacker *SlackAdapter) client() *http.Client {
+	if slacker.HTTPClient != nil {
+		return slacker.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (slacker *SlackAdapter) endpoint() string {
+	if slacker.URLEndpoint != "" {
+		return slacker.URLEndpoint
+	}
+	return slackApiPostMessage
+}
+
+func chatPostMessage(ctx context.Context, client *http.Client, token string, channel string, blockMessage []Block, url string) (*SlackResponse, error) {
 	theMsg := SlackMessageWrapper{
 		Token:   token,
 		Channel: channel,
 		Unfurl:  false,
 		Blocks:  blockMessage,
 	}
+	return slackPost(ctx, client, token, theMsg, url)
+}
+
+func slackPost(ctx context.Context, client *http.Client, token string, theMsg SlackMessageWrapper, url string) (slackResp *SlackResponse, err error) {
+	ctx, span := startCall(ctx, "slack chat.postMessage", url)
+	defer func() { tracing.End(span, err) }()
 
 	marshalled, err := json.Marshal(theMsg)
 	if err != nil {
-		return "", fmt.Errorf("while marshalling SlackMessageWrapper we got: %s", err)
+		return nil, fmt.Errorf("while marshalling SlackMessageWrapper we got: %s", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackApiPostMessage, bytes.NewBuffer(marshalled))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(marshalled))
 	if err != nil {
-		return "", fmt.Errorf("failed calling NewRequestWithContext: %v", err)
+		return nil, fmt.Errorf("failed calling NewRequestWithContext: %v", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-type", "application/json; charset=utf-8")
 
-	client := http.DefaultClient
-
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("couldnt do request: %v", err)
+		return nil, transportError(fmt.Errorf("couldnt do request: %w", err))
 	}
 
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		bod, _ := ioutil.ReadAll(resp.Body)
-		return string(bod), nil
+	return slackResult(resp)
+}
+
+// slackResult decodes a chat.postMessage response, turning "ok": false into
+// a DeliveryError wrapping a SlackAPIError.
+func slackResult(resp *http.Response) (*SlackResponse, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, fmt.Errorf("request was not ok: %v", resp.StatusCode))
+	}
+
+	slackResp := &SlackResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(slackResp); err != nil {
+		return nil, transportError(fmt.Errorf("could not decode slack response: %w", err))
+	}
+
+	if !slackResp.OK {
+		warnings := slackResp.Metadata.Warnings
+		if slackResp.Warning != "" && len(warnings) == 0 {
+			warnings = strings.Split(slackResp.Warning, ",")
+		}
+		return nil, &DeliveryError{
+			StatusCode: resp.StatusCode,
+			Retryable:  slackRetryableErrors[slackResp.Error],
+			Err:        &SlackAPIError{Code: slackResp.Error, Warnings: warnings},
+		}
 	}
 
-	return "", fmt.Errorf("request was not ok: %v", resp.StatusCode)
+	return slackResp, nil
 }
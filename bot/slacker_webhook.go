@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+)
+
+const slackWebhookPrefix = "https://hooks.slack.com/"
+
+// IsSlackWebhook reports whether token is an incoming webhook URL rather than
+// a bot token.
+func IsSlackWebhook(token string) bool {
+	return strings.HasPrefix(token, slackWebhookPrefix)
+}
+
+// webhookPostMessage posts blockMessage to a Slack incoming webhook. Webhooks
+// answer with plain text, "ok" on success or an error code such as
+// "channel_not_found", and don't say which message was posted.
+func webhookPostMessage(ctx context.Context, client *http.Client, blockMessage []Block, url string) (slackResp *SlackResponse, err error) {
+	ctx, span := startCall(ctx, "slack webhook", url)
+	defer func() { tracing.End(span, err) }()
+
+	theMsg := SlackMessageWrapper{
+		Unfurl: false,
+		Blocks: blockMessage,
+	}
+
+	marshalled, err := json.Marshal(theMsg)
+	if err != nil {
+		return nil, fmt.Errorf("while marshalling SlackMessageWrapper we got: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(marshalled))
+	if err != nil {
+		return nil, fmt.Errorf("failed calling NewRequestWithContext: %v", err)
+	}
+
+	req.Header.Set("Content-type", "application/json; charset=utf-8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, transportError(fmt.Errorf("couldnt do request: %w", err))
+	}
+
+	defer resp.Body.Close()
+	bod, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	text := strings.TrimSpace(string(bod))
+
+	if resp.StatusCode == http.StatusOK && text == "ok" {
+		return &SlackResponse{OK: true}, nil
+	}
+	if text == "" {
+		text = http.StatusText(resp.StatusCode)
+	}
+
+	return nil, statusError(resp.StatusCode, &SlackAPIError{Code: text})
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bot
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startRender starts the span around building a message for the chat app.
+func startRender(ctx context.Context, message map[string]string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "deploybot.render", trace.WithAttributes(
+		attribute.String("clouddeploy.resource_type", message["ResourceType"]),
+	))
+}
+
+// startCall starts the span around a chat app API call, named after the API
+// method, e.g. "slack chat.postMessage".
+func startCall(ctx context.Context, name string, endpoint string) (context.Context, trace.Span) {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil {
+		host = u.Host
+	}
+	return tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", "POST"),
+		attribute.String("server.address", host),
+	))
+}
@@ -0,0 +1,419 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/audit"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/policy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/clouddeploy/v1"
+)
+
+const (
+	// actionTimeout bounds an action, leaving time for its API calls. It keeps
+	// within the 30 seconds Google Chat waits, Slack is answered before the
+	// action is taken.
+	actionTimeout = 25 * time.Second
+	// followTimeout bounds how long the progress of a rollout is posted.
+	followTimeout = 30 * time.Minute
+	// pollInterval is how often a rollout being followed is checked.
+	pollInterval = 10 * time.Second
+)
+
+// ErrDenied is returned when a user may not take an action.
+var ErrDenied = errors.New("not allowed")
+
+// User is who clicked a button.
+type User struct {
+	// Platform is "slack" or "google".
+	Platform string
+	// ID is Slack's user ID, e.g. U0123ABCD, or Google Chat's user name, e.g.
+	// users/1234567890.
+	ID   string
+	Name string
+}
+
+// Mention is how to mention the user in a message.
+func (u User) Mention() string {
+	if u.Platform == "slack" {
+		return fmt.Sprintf("<@%s>", u.ID)
+	}
+	return fmt.Sprintf("<%s>", u.ID)
+}
+
+// Thread is where the message whose button was clicked is, to post under it.
+type Thread struct {
+	Channel string
+	// Name is the Slack message timestamp or the Google Chat thread name.
+	Name string
+}
+
+// Actions carries out the actions users take from the buttons of messages.
+type Actions struct {
+	Deploy *gcpclouddeploy.Client
+	// Policy decides who may take which action. Without one every action is
+	// denied.
+	Policy *policy.Policy
+	// Replier posts the progress of rollbacks in the thread of the message.
+	// Without one it isn't followed.
+	Replier bot.Replier
+	// PollInterval overrides how often the progress is checked, e.g. in tests.
+	PollInterval time.Duration
+	// Audit records every action, audit.Log if nil.
+	Audit audit.Sink
+
+	following sync.WaitGroup
+	closeOnce sync.Once
+	mu        sync.Mutex
+	// closing is closed by Close to stop following rollouts.
+	closing chan struct{}
+}
+
+// Run takes the action v on behalf of user and returns the text telling how
+// it went, and the audit entry recorded for it. thread is where the message
+// with the button is.
+func (a *Actions) Run(ctx context.Context, user User, v bot.ActionValue, thread Thread) (string, audit.Entry, error) {
+	ctx, span := tracing.Start(ctx, "deploybot.action", trace.WithAttributes(
+		attribute.String("deploybot.action", v.Action),
+		attribute.String("clouddeploy.pipeline", v.Pipeline),
+		attribute.String("clouddeploy.release", v.Release),
+		attribute.String("clouddeploy.target", v.Target),
+	))
+
+	var text string
+	var err error
+	switch v.Action {
+	case bot.ActionPromote:
+		text, err = a.promote(ctx, user, v)
+	case bot.ActionRollback:
+		text, err = a.rollback(ctx, user, v, thread)
+	case bot.ActionRetry:
+		text, err = a.retry(ctx, user, &v)
+	case bot.ActionCancel:
+		text, err = a.cancel(ctx, user, v)
+	case bot.ActionAdvance:
+		text, err = a.advance(ctx, user, v)
+	default:
+		err = fmt.Errorf("unknown action %q", v.Action)
+	}
+	tracing.End(span, err)
+
+	entry := a.record(ctx, user, v, err)
+	return text, entry, err
+}
+
+// record writes the audit entry telling who took the action v and how it
+// went.
+func (a *Actions) record(ctx context.Context, user User, v bot.ActionValue, err error) audit.Entry {
+	entry := audit.Entry{
+		Time:      time.Now(),
+		Platform:  user.Platform,
+		UserID:    user.ID,
+		UserName:  user.Name,
+		Principal: a.Policy.Principal(user.ID),
+		Action:    v.Action,
+		Project:   v.Project,
+		Location:  v.Location,
+		Pipeline:  v.Pipeline,
+		Release:   v.Release,
+		Rollout:   v.Rollout,
+		Target:    v.Target,
+		Phase:     v.Phase,
+		Job:       v.Job,
+		Result:    audit.ResultDone,
+	}
+	if errors.Is(err, ErrDenied) {
+		entry.Result, entry.Error = audit.ResultDenied, err.Error()
+	} else if err != nil {
+		entry.Result, entry.Error = audit.ResultFailed, err.Error()
+	}
+
+	sink := a.Audit
+	if sink == nil {
+		sink = audit.Log
+	}
+	if err := sink.Write(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, "could not record audit entry", "error", err)
+	}
+	return entry
+}
+
+func (a *Actions) promote(ctx context.Context, user User, v bot.ActionValue) (string, error) {
+	next, err := a.Deploy.NextTarget(ctx, v.ReleaseName(), v.Target)
+	if err != nil {
+		return "", err
+	}
+	if !a.allowed(ctx, user, v, next) {
+		return "", fmt.Errorf("%s can't promote to %s: %w", user.Mention(), next, ErrDenied)
+	}
+
+	rollout, err := a.Deploy.CreateRollout(ctx, v.ReleaseName(), next)
+	if err != nil {
+		return "", err
+	}
+
+	id := gcpclouddeploy.ResourceID(rollout)
+	return fmt.Sprintf("🚀 %s promoted release %s to %s: <%s|%s>", user.Mention(), v.Release, next, rolloutLink(v, id), id), nil
+}
+
+// rollback deploys the release which ran on the target before v's release,
+// then follows the rollout in thread.
+func (a *Actions) rollback(ctx context.Context, user User, v bot.ActionValue, thread Thread) (string, error) {
+	if !a.allowed(ctx, user, v, v.Target) {
+		return "", fmt.Errorf("%s can't roll back %s: %w", user.Mention(), v.Target, ErrDenied)
+	}
+
+	previous, err := a.Deploy.PreviousRelease(ctx, v.ReleaseName(), v.Target)
+	if err != nil {
+		return "", err
+	}
+	rollout, err := a.Deploy.CreateRollout(ctx, previous, v.Target)
+	if err != nil {
+		return "", err
+	}
+
+	if a.Replier != nil && thread.Channel != "" {
+		a.following.Add(1)
+		go a.follow(context.WithoutCancel(ctx), rollout, thread)
+	}
+
+	back := v
+	back.Release = gcpclouddeploy.ResourceID(previous)
+	id := gcpclouddeploy.ResourceID(rollout)
+	return fmt.Sprintf("⏪ %s is rolling %s back to release %s: <%s|%s>", user.Mention(), v.Target, back.Release, rolloutLink(back, id), id), nil
+}
+
+// retry runs the failed job of v's rollout again. v is completed with the job
+// when the button didn't carry it.
+func (a *Actions) retry(ctx context.Context, user User, v *bot.ActionValue) (string, error) {
+	if !a.allowed(ctx, user, *v, v.Target) {
+		return "", fmt.Errorf("%s can't retry jobs on %s: %w", user.Mention(), v.Target, ErrDenied)
+	}
+
+	if v.Phase == "" || v.Job == "" {
+		phase, job, err := a.Deploy.FailedJob(ctx, v.RolloutName())
+		if err != nil {
+			return "", err
+		}
+		v.Phase, v.Job = phase, job
+	}
+	if err := a.Deploy.RetryJob(ctx, v.RolloutName(), v.Phase, v.Job); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("🔁 %s retried the %s job of the %s phase of rollout <%s|%s>", user.Mention(), v.Job, v.Phase, rolloutLink(*v, v.Rollout), v.Rollout), nil
+}
+
+// cancel stops v's rollout.
+func (a *Actions) cancel(ctx context.Context, user User, v bot.ActionValue) (string, error) {
+	if !a.allowed(ctx, user, v, v.Target) {
+		return "", fmt.Errorf("%s can't cancel rollouts to %s: %w", user.Mention(), v.Target, ErrDenied)
+	}
+
+	if err := a.Deploy.CancelRollout(ctx, v.RolloutName()); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("🛑 %s cancelled rollout <%s|%s> of release %s to %s", user.Mention(), rolloutLink(v, v.Rollout), v.Rollout, v.Release, v.Target), nil
+}
+
+// advance moves v's canary rollout on to the phase after v's.
+func (a *Actions) advance(ctx context.Context, user User, v bot.ActionValue) (string, error) {
+	if !a.allowed(ctx, user, v, v.Target) {
+		return "", fmt.Errorf("%s can't advance rollouts to %s: %w", user.Mention(), v.Target, ErrDenied)
+	}
+
+	r, err := a.Deploy.Rollout(ctx, v.RolloutName())
+	if err != nil {
+		return "", err
+	}
+	next, err := gcpclouddeploy.NextPhase(r, v.Phase)
+	if err != nil {
+		return "", err
+	}
+	if err := a.Deploy.AdvanceRollout(ctx, v.RolloutName(), next); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("⏩ %s advanced rollout <%s|%s> to %s: %s", user.Mention(), rolloutLink(v, v.Rollout), v.Rollout, next, phases(r, next)), nil
+}
+
+// phases shows the progress through the phases of r, e.g.
+// "canary-25 ✅ → *canary-50* → stable" when advancing to canary-50.
+func phases(r *clouddeploy.Rollout, current string) string {
+	var steps []string
+	for _, phase := range r.Phases {
+		switch {
+		case phase.Id == current:
+			steps = append(steps, "*"+phase.Id+"*")
+		case phase.State == "SUCCEEDED":
+			steps = append(steps, phase.Id+" ✅")
+		default:
+			steps = append(steps, phase.Id)
+		}
+	}
+	return strings.Join(steps, " → ")
+}
+
+// follow posts in thread each time the rollout with the resource name
+// rollout changes state, until it is over.
+func (a *Actions) follow(ctx context.Context, rollout string, thread Thread) {
+	defer a.following.Done()
+	ctx, cancel := context.WithTimeout(ctx, followTimeout)
+	defer cancel()
+
+	interval := a.PollInterval
+	if interval == 0 {
+		interval = pollInterval
+	}
+
+	state := ""
+	for {
+		select {
+		case <-ctx.Done():
+			a.reply(context.WithoutCancel(ctx), thread, stoppedFollowing(rollout, state))
+			return
+		case <-a.closed():
+			a.reply(ctx, thread, fmt.Sprintf("⌛ Stopped following rollout %s as the bot is shutting down.", path.Base(rollout)))
+			return
+		case <-time.After(interval):
+		}
+
+		r, err := a.Deploy.Rollout(ctx, rollout)
+		if err != nil {
+			slog.WarnContext(ctx, "could not check rollout", "rollout", rollout, "error", err)
+			continue
+		}
+		if r.State == state {
+			continue
+		}
+		state = r.State
+
+		text, done := progress(r)
+		if text != "" {
+			a.reply(ctx, thread, text)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// stoppedFollowing is the text telling the rollout with the resource name
+// rollout, last seen in state, isn't followed anymore.
+func stoppedFollowing(rollout string, state string) string {
+	if state == "" {
+		// The rollout couldn't be read before the timeout.
+		state = "in progress"
+	}
+	return fmt.Sprintf("⌛ Stopped following rollout %s, which is still %s.", path.Base(rollout), state)
+}
+
+func (a *Actions) reply(ctx context.Context, thread Thread, text string) {
+	if err := a.Replier.Reply(ctx, thread.Channel, thread.Name, text); err != nil {
+		slog.ErrorContext(ctx, "could not post rollout progress", "error", err)
+	}
+}
+
+// wait returns once no rollout is followed anymore.
+func (a *Actions) wait() {
+	a.following.Wait()
+}
+
+// Close stops following rollouts, posting that they aren't followed anymore,
+// and waits for those posts until ctx is done.
+func (a *Actions) Close(ctx context.Context) error {
+	a.closeOnce.Do(func() { close(a.closed()) })
+	return waitFor(ctx, &a.following)
+}
+
+// closed is closed once Close is called.
+func (a *Actions) closed() chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closing == nil {
+		a.closing = make(chan struct{})
+	}
+	return a.closing
+}
+
+// waitFor waits for wg until ctx is done.
+func waitFor(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// progress is the text telling the state of r, if worth posting, and whether
+// r is over.
+func progress(r *clouddeploy.Rollout) (string, bool) {
+	id := gcpclouddeploy.ResourceID(r.Name)
+	switch r.State {
+	case "PENDING_APPROVAL":
+		return fmt.Sprintf("🔒 Rollout %s is waiting for approval.", id), false
+	case "IN_PROGRESS":
+		return fmt.Sprintf("⏳ Rollout %s is deploying.", id), false
+	case "SUCCEEDED":
+		return fmt.Sprintf("✅ Rollout %s succeeded on %s.", id, r.TargetId), true
+	case "FAILED", "HALTED", "CANCELLED", "APPROVAL_REJECTED":
+		text := fmt.Sprintf("⚠️ Rollout %s ended %s.", id, r.State)
+		if r.FailureReason != "" {
+			text = fmt.Sprintf("⚠️ Rollout %s ended %s: %s", id, r.State, r.FailureReason)
+		}
+		return text, true
+	}
+	return "", false
+}
+
+// allowed tells whether user may take the action v on target.
+func (a *Actions) allowed(ctx context.Context, user User, v bot.ActionValue, target string) bool {
+	return a.Policy.Decide(ctx, policy.Request{UserID: user.ID, Action: v.Action, Pipeline: v.Pipeline, Target: target}).Allowed
+}
+
+// failure is the text telling an action failed.
+func failure(v bot.ActionValue, err error) string {
+	if errors.Is(err, ErrDenied) {
+		return fmt.Sprintf("🚫 %v", err)
+	}
+	return fmt.Sprintf("⚠️ Could not %s release %s: %v", v.Action, v.Release, err)
+}
+
+func rolloutLink(v bot.ActionValue, rollout string) string {
+	return fmt.Sprintf("https://console.cloud.google.com/deploy/delivery-pipelines/%s/%s/releases/%s/rollouts/%s?project=%s", v.Location, v.Pipeline, v.Release, rollout, v.Project)
+}
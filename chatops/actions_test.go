@@ -0,0 +1,494 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/audit"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy/fake"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/policy"
+	"google.golang.org/api/chat/v1"
+)
+
+// promoteValue promotes rel-2 of the sample pipeline from target.
+func promoteValue(target string) bot.ActionValue {
+	return bot.ActionValue{
+		Action:   bot.ActionPromote,
+		Project:  "my-project",
+		Location: "us-central1",
+		Pipeline: "web-app",
+		Release:  "rel-2",
+		Rollout:  "rel-2-to-" + target + "-0001",
+		Target:   target,
+	}
+}
+
+// reply is one posted by fakeReplier.
+type reply struct {
+	channel, thread, text string
+}
+
+// allow lets the users with ids take any action on target, or on every
+// target with "*".
+func allow(target string, ids ...string) *policy.Policy {
+	p := &policy.Policy{Users: make(map[string]string)}
+	rule := policy.Rule{Actions: []string{policy.Any}}
+	if target != policy.Any {
+		rule.Targets = []string{target}
+	}
+	for _, id := range ids {
+		p.Users[id] = "user:" + path.Base(id) + "@example.com"
+		rule.Principals = append(rule.Principals, p.Users[id])
+	}
+	p.Rules = []policy.Rule{rule}
+	return p
+}
+
+// fakeReplier records the replies.
+type fakeReplier struct {
+	mu      sync.Mutex
+	replies []reply
+}
+
+func (f *fakeReplier) Reply(ctx context.Context, channel string, thread string, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, reply{channel, thread, text})
+	return nil
+}
+
+// last is the latest reply.
+func (f *fakeReplier) last() reply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.replies) == 0 {
+		return reply{}
+	}
+	return f.replies[len(f.replies)-1]
+}
+
+// fakeSink records the audit entries.
+type fakeSink struct {
+	entries []audit.Entry
+}
+
+func (f *fakeSink) Write(ctx context.Context, e audit.Entry) error {
+	f.entries = append(f.entries, e)
+	return nil
+}
+
+// creates returns the POST calls made to server.
+func creates(server *fake.Server) []fake.Call {
+	var calls []fake.Call
+	for _, call := range server.Calls() {
+		if call.Method == http.MethodPost {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestPromote(t *testing.T) {
+	var testTable = []struct {
+		name       string
+		user       User
+		target     string
+		want       string
+		wantErr    error
+		wantResult string
+	}{
+		{"Allowed", User{Platform: "slack", ID: "U123"}, "staging", "🚀 <@U123> promoted release rel-2 to prod: <", nil, audit.ResultDone},
+		{"Denied", User{Platform: "slack", ID: "U456"}, "staging", "", ErrDenied, audit.ResultDenied},
+		{"Last target", User{Platform: "slack", ID: "U123"}, "prod", "", errors.New("last target"), audit.ResultFailed},
+	}
+
+	for _, test := range testTable {
+		deploy, server := testDeploy(t)
+		sink := &fakeSink{}
+		actions := &Actions{Deploy: deploy, Policy: allow("prod", "U123"), Audit: sink}
+
+		text, entry, err := actions.Run(context.Background(), test.user, promoteValue(test.target), Thread{})
+		if (err != nil) != (test.wantErr != nil) {
+			t.Fatalf("%s: wanted error %v, got: %v", test.name, test.wantErr, err)
+		}
+		if errors.Is(test.wantErr, ErrDenied) && !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: wanted ErrDenied, got: %v", test.name, err)
+		}
+		if !strings.HasPrefix(text, test.want) {
+			t.Errorf("%s: wanted text starting with %q, got: %q", test.name, test.want, text)
+		}
+		if len(sink.entries) != 1 || sink.entries[0] != entry || entry.Result != test.wantResult || entry.UserID != test.user.ID || entry.Rollout != "rel-2-to-"+test.target+"-0001" {
+			t.Errorf("%s: wanted one %s audit entry, got: %+v", test.name, test.wantResult, sink.entries)
+		}
+
+		calls := creates(server)
+		if test.wantErr != nil {
+			if len(calls) != 0 {
+				t.Errorf("%s: wanted no rollout, got: %v", test.name, calls)
+			}
+			continue
+		}
+		if len(calls) != 1 || !strings.HasSuffix(calls[0].Name, "/releases/rel-2/rollouts") || !strings.Contains(calls[0].Query, "rolloutId=rel-2-to-prod-0002") {
+			t.Errorf("%s: wanted rollout rel-2-to-prod-0002 to be created, got: %v", test.name, calls)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	var testTable = []struct {
+		name    string
+		user    User
+		release string
+		want    string
+		wantErr bool
+	}{
+		{"Allowed", User{Platform: "slack", ID: "U123"}, "rel-2", "⏪ <@U123> is rolling prod back to release rel-1: <", false},
+		{"Denied", User{Platform: "slack", ID: "U456"}, "rel-2", "", true},
+		{"Nothing before", User{Platform: "slack", ID: "U123"}, "rel-1", "", true},
+	}
+
+	for _, test := range testTable {
+		deploy, server := testDeploy(t)
+		replier := &fakeReplier{}
+		actions := &Actions{Deploy: deploy, Policy: allow("prod", "U123"), Replier: replier, PollInterval: time.Millisecond}
+
+		v := promoteValue("prod")
+		v.Action, v.Release = bot.ActionRollback, test.release
+		text, _, err := actions.Run(context.Background(), test.user, v, Thread{Channel: "C456", Name: "1622628000.000100"})
+		if (err != nil) != test.wantErr {
+			t.Fatalf("%s: wanted error %v, got: %v", test.name, test.wantErr, err)
+		}
+		if !strings.HasPrefix(text, test.want) {
+			t.Errorf("%s: wanted text starting with %q, got: %q", test.name, test.want, text)
+		}
+
+		calls := creates(server)
+		if test.wantErr {
+			if len(calls) != 0 {
+				t.Errorf("%s: wanted no rollout, got: %v", test.name, calls)
+			}
+			continue
+		}
+		if len(calls) != 1 || !strings.HasSuffix(calls[0].Name, "/releases/rel-1/rollouts") || !strings.Contains(calls[0].Query, "rolloutId=rel-1-to-prod-0002") {
+			t.Fatalf("%s: wanted rollout rel-1-to-prod-0002 to be created, got: %v", test.name, calls)
+		}
+
+		// The rollout finishes, the progress is posted until then.
+		server.Add(calls[0].Name+"/rel-1-to-prod-0002", map[string]interface{}{"targetId": "prod", "state": "SUCCEEDED"})
+		actions.wait()
+		if got := replier.last(); got.channel != "C456" || got.thread != "1622628000.000100" || got.text != "✅ Rollout rel-1-to-prod-0002 succeeded on prod." {
+			t.Errorf("%s: wanted the rollout's success in the thread, got: %+v", test.name, got)
+		}
+	}
+}
+
+func TestStoppedFollowing(t *testing.T) {
+	var testTable = []struct {
+		state string
+		want  string
+	}{
+		{"IN_PROGRESS", "⌛ Stopped following rollout rel-1-to-prod-0002, which is still IN_PROGRESS."},
+		{"", "⌛ Stopped following rollout rel-1-to-prod-0002, which is still in progress."},
+	}
+
+	for _, test := range testTable {
+		if got := stoppedFollowing("projects/p/locations/l/deliveryPipelines/web-app/releases/rel-1/rollouts/rel-1-to-prod-0002", test.state); got != test.want {
+			t.Errorf("%q: wanted %q, got: %q", test.state, test.want, got)
+		}
+	}
+}
+
+func TestCloseStopsFollowing(t *testing.T) {
+	deploy, _ := testDeploy(t)
+	replier := &fakeReplier{}
+	actions := &Actions{Deploy: deploy, Policy: allow("prod", "U123"), Replier: replier, PollInterval: time.Hour}
+
+	v := promoteValue("prod")
+	v.Action = bot.ActionRollback
+	if _, _, err := actions.Run(context.Background(), User{Platform: "slack", ID: "U123"}, v, Thread{Channel: "C456", Name: "1622628000.000100"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := actions.Close(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := replier.last(); got.text != "⌛ Stopped following rollout rel-1-to-prod-0002 as the bot is shutting down." {
+		t.Errorf("wanted the rollout left in the thread, got: %+v", got)
+	}
+}
+
+func TestRetryAndCancel(t *testing.T) {
+	var testTable = []struct {
+		name     string
+		user     User
+		action   string
+		rollout  string
+		want     string
+		wantCall string
+		wantBody map[string]interface{}
+	}{
+		{"Retry", User{Platform: "slack", ID: "U123"}, bot.ActionRetry, "rel-2-to-prod-0001", "🔁 <@U123> retried the verify job of the stable phase of rollout <", "rel-2-to-prod-0001:retryJob", map[string]interface{}{"phaseId": "stable", "jobId": "verify"}},
+		{"Cancel", User{Platform: "slack", ID: "U123"}, bot.ActionCancel, "rel-2-to-prod-0001", "🛑 <@U123> cancelled rollout <", "rel-2-to-prod-0001:cancel", map[string]interface{}{}},
+		{"Denied", User{Platform: "slack", ID: "U456"}, bot.ActionCancel, "rel-2-to-prod-0001", "", "", nil},
+		{"Nothing to retry", User{Platform: "slack", ID: "U123"}, bot.ActionRetry, "rel-2-to-staging-0001", "", "", nil},
+	}
+
+	for _, test := range testTable {
+		deploy, server := testDeploy(t)
+		actions := &Actions{Deploy: deploy, Policy: allow("*", "U123")}
+
+		v := promoteValue("prod")
+		v.Action, v.Rollout = test.action, test.rollout
+		text, _, err := actions.Run(context.Background(), test.user, v, Thread{})
+		if (err != nil) != (test.wantCall == "") {
+			t.Fatalf("%s: wanted error %v, got: %v", test.name, test.wantCall == "", err)
+		}
+		if !strings.HasPrefix(text, test.want) {
+			t.Errorf("%s: wanted text starting with %q, got: %q", test.name, test.want, text)
+		}
+
+		calls := creates(server)
+		if test.wantCall == "" {
+			if len(calls) != 0 {
+				t.Errorf("%s: wanted no call, got: %v", test.name, calls)
+			}
+			continue
+		}
+		if len(calls) != 1 || !strings.HasSuffix(calls[0].Name, test.wantCall) || !reflect.DeepEqual(calls[0].Body, test.wantBody) {
+			t.Errorf("%s: wanted %s with %v, got: %v", test.name, test.wantCall, test.wantBody, calls)
+		}
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	deploy, server := testDeploy(t)
+	actions := &Actions{Deploy: deploy, Policy: allow("prod", "U123")}
+	rollout := "projects/my-project/locations/us-central1/deliveryPipelines/web-app/releases/rel-2/rollouts/rel-2-to-prod-0002"
+	server.Add(rollout, map[string]interface{}{
+		"targetId": "prod", "state": "IN_PROGRESS",
+		"phases": []map[string]interface{}{
+			{"id": "canary-25", "state": "SUCCEEDED"},
+			{"id": "canary-50", "state": "PENDING"},
+			{"id": "stable", "state": "PENDING"},
+		},
+	})
+
+	v := promoteValue("prod")
+	v.Action, v.Rollout, v.Phase = bot.ActionAdvance, "rel-2-to-prod-0002", "canary-25"
+	text, _, err := actions.Run(context.Background(), User{Platform: "slack", ID: "U123"}, v, Thread{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(text, "to canary-50: canary-25 ✅ → *canary-50* → stable") {
+		t.Errorf("wanted the progress through the phases, got: %q", text)
+	}
+	calls := creates(server)
+	if len(calls) != 1 || calls[0].Name != rollout+":advance" || calls[0].Body["phaseId"] != "canary-50" {
+		t.Errorf("wanted the rollout to be advanced to canary-50, got: %v", calls)
+	}
+
+	v.Phase = "stable"
+	if _, _, err := actions.Run(context.Background(), User{Platform: "slack", ID: "U123"}, v, Thread{}); err == nil {
+		t.Errorf("wanted an error advancing past stable")
+	}
+}
+
+func TestSlackInteractions(t *testing.T) {
+	deploy, server := testDeploy(t)
+	replier := &fakeReplier{}
+	updates := make(chan map[string]interface{}, 1)
+	responses := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		update := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&update)
+		updates <- update
+	}))
+	defer responses.Close()
+
+	interactions := &SlackInteractions{
+		SigningSecret: signingSecret,
+		Actions:       &Actions{Deploy: deploy, Policy: allow("*", "U123")},
+		Replier:       replier,
+		HTTPClient:    responses.Client(),
+	}
+
+	payload := `{
+		"type": "block_actions",
+		"user": {"id": "U123", "username": "alice"},
+		"channel": {"id": "C456"},
+		"message": {"ts": "1622628000.000100", "blocks": [{"type": "header"}, {"type": "actions"}]},
+		"response_url": "` + responses.URL + `",
+		"actions": [{"action_id": "promote", "value": ` + jsonString(promoteValue("staging").String()) + `}]
+	}`
+	body := url.Values{"payload": {payload}}.Encode()
+
+	rec := httptest.NewRecorder()
+	interactions.ServeHTTP(rec, slackRequest("POST", "/slack/interactions", body, signingSecret, time.Now()))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wanted status 200, got: %d", rec.Code)
+	}
+	interactions.Wait(context.Background())
+	if got := replier.last(); got.channel != "C456" || got.thread != "1622628000.000100" || !strings.Contains(got.text, "promoted release rel-2 to prod") {
+		t.Errorf("wanted the outcome in the message's thread, got: %+v", got)
+	}
+	if calls := creates(server); len(calls) != 1 {
+		t.Errorf("wanted one rollout to be created, got: %v", calls)
+	}
+	update := <-updates
+	b, _ := json.Marshal(update)
+	if update["replace_original"] != true || strings.Contains(string(b), `"actions"`) || !strings.Contains(string(b), `"text":"🚀 \u003c@U123\u003e promoted`) || !strings.Contains(string(b), `"type":"context"`) {
+		t.Errorf("wanted the buttons replaced by the outcome, got: %s", b)
+	}
+	if !strings.Contains(string(b), `"text":"🧾 promote of rel-2-to-staging-0001 by alice: done, `) {
+		t.Errorf("wanted the audit summary under the message, got: %s", b)
+	}
+
+	// Denied actions keep the buttons but are recorded under the message too.
+	interactions.Actions.Policy = allow("*", "U456")
+	rec = httptest.NewRecorder()
+	interactions.ServeHTTP(rec, slackRequest("POST", "/slack/interactions", body, signingSecret, time.Now()))
+	interactions.Wait(context.Background())
+	update = <-updates
+	b, _ = json.Marshal(update)
+	if !strings.Contains(string(b), `"actions"`) || !strings.Contains(string(b), `by alice: denied, `) {
+		t.Errorf("wanted the buttons and the denial under the message, got: %s", b)
+	}
+
+	rec = httptest.NewRecorder()
+	interactions.ServeHTTP(rec, slackRequest("POST", "/slack/interactions", body, "wrong", time.Now()))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wanted unsigned interactions to be rejected, got: %d", rec.Code)
+	}
+}
+
+func TestChatEvents(t *testing.T) {
+	deploy, server := testDeploy(t)
+	replier := &fakeReplier{}
+	updater := &fakeUpdater{}
+	events := &ChatEvents{
+		Actions: &Actions{Deploy: deploy, Policy: allow("prod", "users/123")},
+		Replier: replier,
+		Updater: updater,
+	}
+	buttons := &chat.GoogleAppsCardV1ButtonList{Buttons: []*chat.GoogleAppsCardV1Button{
+		{Text: "Open", OnClick: &chat.GoogleAppsCardV1OnClick{OpenLink: &chat.GoogleAppsCardV1OpenLink{Url: "https://console.cloud.google.com"}}},
+		{Text: "Promote", OnClick: &chat.GoogleAppsCardV1OnClick{Action: &chat.GoogleAppsCardV1Action{Function: bot.ActionPromote}}},
+	}}
+	card := &chat.GoogleAppsCardV1Card{Sections: []*chat.GoogleAppsCardV1Section{{Widgets: []*chat.GoogleAppsCardV1Widget{{ButtonList: buttons}}}}}
+
+	event := func(dialogEventType string) *http.Request {
+		b, _ := json.Marshal(&chat.DeprecatedEvent{
+			Type:            "CARD_CLICKED",
+			IsDialogEvent:   true,
+			DialogEventType: dialogEventType,
+			User:            &chat.User{Name: "users/123", DisplayName: "Alice"},
+			Space:           &chat.Space{Name: "spaces/AAAA"},
+			Message: &chat.Message{
+				Name:    "spaces/AAAA/messages/CCCC",
+				Thread:  &chat.Thread{Name: "spaces/AAAA/threads/BBBB"},
+				CardsV2: []*chat.CardWithId{{CardId: "rollout", Card: card}},
+			},
+			Common: &chat.CommonEventObject{
+				InvokedFunction: bot.ActionPromote,
+				Parameters:      map[string]string{"value": promoteValue("staging").String(), "confirm": "Promote?"},
+			},
+		})
+		return httptest.NewRequest("POST", "/chat/events", bytes.NewReader(b))
+	}
+
+	var testTable = []struct {
+		dialogEventType string
+		wantDialog      bool
+		wantStatus      string
+		wantRollouts    int
+	}{
+		{"REQUEST_DIALOG", true, "", 0},
+		{"CANCEL_DIALOG", false, "", 0},
+		{"SUBMIT_DIALOG", false, "promoted release rel-2 to prod", 1},
+	}
+
+	for _, test := range testTable {
+		rec := httptest.NewRecorder()
+		events.ServeHTTP(rec, event(test.dialogEventType))
+
+		msg := &chat.Message{}
+		if err := json.NewDecoder(rec.Body).Decode(msg); err != nil {
+			t.Fatalf("%s: could not decode response: %v", test.dialogEventType, err)
+		}
+		if msg.ActionResponse == nil || msg.ActionResponse.DialogAction == nil {
+			t.Fatalf("%s: wanted a dialog action, got: %+v", test.dialogEventType, msg)
+		}
+		action := msg.ActionResponse.DialogAction
+		if (action.Dialog != nil) != test.wantDialog {
+			t.Errorf("%s: wanted a dialog %v, got: %+v", test.dialogEventType, test.wantDialog, action)
+		}
+		if !test.wantDialog && (action.ActionStatus == nil || !strings.Contains(action.ActionStatus.UserFacingMessage, test.wantStatus)) {
+			t.Errorf("%s: wanted status %q, got: %+v", test.dialogEventType, test.wantStatus, action.ActionStatus)
+		}
+		if calls := creates(server); len(calls) != test.wantRollouts {
+			t.Errorf("%s: wanted %d rollouts to be created, got: %v", test.dialogEventType, test.wantRollouts, calls)
+		}
+	}
+
+	if got := replier.last(); got.channel != "AAAA" || got.thread != "spaces/AAAA/threads/BBBB" || !strings.Contains(got.text, "<users/123> promoted") {
+		t.Errorf("wanted the outcome in the message's thread, got: %+v", got)
+	}
+
+	if updater.name != "spaces/AAAA/messages/CCCC" || updater.msg == nil {
+		t.Fatalf("wanted the message to be updated, got: %q", updater.name)
+	}
+	sections := updater.msg.CardsV2[0].Card.Sections
+	if len(sections) != 2 || len(sections[0].Widgets[0].ButtonList.Buttons) != 1 || len(sections[1].Widgets) != 2 ||
+		!strings.HasPrefix(sections[1].Widgets[0].TextParagraph.Text, "🚀 Alice promoted release rel-2 to prod: <a href=") ||
+		!strings.HasPrefix(sections[1].Widgets[1].TextParagraph.Text, "🧾 promote of rel-2-to-staging-0001 by Alice: done, ") {
+		b, _ := json.Marshal(updater.msg)
+		t.Errorf("wanted the action button replaced by the outcome and its audit summary, got: %s", b)
+	}
+	if len(buttons.Buttons) != 2 {
+		t.Errorf("wanted the event's message to be left as is")
+	}
+}
+
+// fakeUpdater records the last update.
+type fakeUpdater struct {
+	name string
+	msg  *chat.Message
+}
+
+func (f *fakeUpdater) UpdateChatMessage(ctx context.Context, name string, msg *chat.Message) error {
+	f.name, f.msg = name, msg
+	return nil
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
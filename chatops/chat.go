@@ -0,0 +1,257 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"google.golang.org/api/chat/v1"
+)
+
+// ChatSender is the identity Google Chat calls apps with. Its tokens can be
+// checked with push.Verifier when the app's authentication audience is its
+// HTTP endpoint URL.
+const ChatSender = "chat@system.gserviceaccount.com"
+
+// ChatEvents handles the interaction events Google Chat sends the app when
+// buttons of its messages are clicked. The buttons first open a dialog asking
+// for confirmation, the action is taken once it is submitted. Requests must
+// be authenticated before reaching it.
+type ChatEvents struct {
+	Actions *Actions
+	// Replier posts the outcome in the thread of the message.
+	Replier bot.Replier
+	// Updater replaces the buttons of the message with the outcome, if set.
+	Updater bot.ChatUpdater
+}
+
+// link and bold match the markup of the outcome texts, e.g. <https://...|rel-1>
+// and *canary-50*.
+var (
+	link = regexp.MustCompile(`<(https://[^|>]+)\|([^>]+)>`)
+	bold = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+func (c *ChatEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	event := &chat.DeprecatedEvent{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(event); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode event: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The request ending mustn't cancel an action half way.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), actionTimeout)
+	defer cancel()
+
+	writeJSON(w, c.handle(ctx, event))
+}
+
+func (c *ChatEvents) handle(ctx context.Context, event *chat.DeprecatedEvent) *chat.Message {
+	// The bot only reacts to its buttons, e.g. not to being mentioned.
+	if event.Type != "CARD_CLICKED" || event.Common == nil {
+		return &chat.Message{}
+	}
+	if event.DialogEventType == "CANCEL_DIALOG" {
+		return closeDialog("")
+	}
+
+	params := event.Common.Parameters
+	v, err := bot.ParseActionValue(params["value"])
+	if err != nil {
+		slog.WarnContext(ctx, "ignoring Google Chat action", "function", event.Common.InvokedFunction, "error", err)
+		return closeDialog(err.Error())
+	}
+
+	if event.DialogEventType == "REQUEST_DIALOG" {
+		return confirmDialog(event.Common.InvokedFunction, params)
+	}
+
+	user := User{Platform: "google"}
+	if event.User != nil {
+		user.ID, user.Name = event.User.Name, event.User.DisplayName
+	}
+	where := Thread{}
+	if event.Space != nil && thread(event) != nil {
+		where = Thread{Channel: strings.TrimPrefix(event.Space.Name, "spaces/"), Name: thread(event).Name}
+	}
+	text, entry, err := c.Actions.Run(ctx, user, v, where)
+	if err != nil {
+		text = failure(v, err)
+	}
+	if c.Updater != nil && event.Message != nil && len(event.Message.CardsV2) > 0 {
+		// The buttons stay when the action failed, so it can be tried again.
+		update := updatedCards(event.Message, false, entry.Summary())
+		if err == nil {
+			update = updatedCards(event.Message, true, cardText(text, user), entry.Summary())
+		}
+		if err := c.Updater.UpdateChatMessage(ctx, event.Message.Name, update); err != nil {
+			slog.WarnContext(ctx, "could not update message", "error", err)
+		}
+	}
+
+	if !event.IsDialogEvent {
+		return &chat.Message{
+			Text:           text,
+			Thread:         thread(event),
+			ActionResponse: &chat.ActionResponse{Type: "NEW_MESSAGE"},
+		}
+	}
+
+	// A dialog can only be closed, so the outcome goes in the thread.
+	if c.Replier != nil && where.Channel != "" {
+		if err := c.Replier.Reply(ctx, where.Channel, where.Name, text); err != nil {
+			slog.ErrorContext(ctx, "could not post action outcome", "error", err)
+		}
+	}
+	return closeDialog(text)
+}
+
+// confirmDialog asks for confirmation before running function again.
+func confirmDialog(function string, params map[string]string) *chat.Message {
+	card := &chat.GoogleAppsCardV1Card{
+		Header: &chat.GoogleAppsCardV1CardHeader{Title: "Are you sure?"},
+		Sections: []*chat.GoogleAppsCardV1Section{
+			{
+				Widgets: []*chat.GoogleAppsCardV1Widget{
+					{TextParagraph: &chat.GoogleAppsCardV1TextParagraph{Text: params["confirm"]}},
+				},
+			},
+		},
+		FixedFooter: &chat.GoogleAppsCardV1CardFixedFooter{
+			PrimaryButton: &chat.GoogleAppsCardV1Button{
+				Text: "Yes",
+				OnClick: &chat.GoogleAppsCardV1OnClick{
+					Action: &chat.GoogleAppsCardV1Action{
+						Function: function,
+						Parameters: []*chat.GoogleAppsCardV1ActionParameter{
+							{Key: "value", Value: params["value"]},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return &chat.Message{
+		ActionResponse: &chat.ActionResponse{
+			Type:         "DIALOG",
+			DialogAction: &chat.DialogAction{Dialog: &chat.Dialog{Body: card}},
+		},
+	}
+}
+
+// closeDialog closes the dialog, showing text to the user if not empty.
+func closeDialog(text string) *chat.Message {
+	return &chat.Message{
+		ActionResponse: &chat.ActionResponse{
+			Type: "DIALOG",
+			DialogAction: &chat.DialogAction{
+				ActionStatus: &chat.ActionStatus{StatusCode: "OK", UserFacingMessage: text},
+			},
+		},
+	}
+}
+
+// updatedCards are the cards of msg followed by lines, e.g. telling what was
+// done. When done the action buttons are removed.
+func updatedCards(msg *chat.Message, done bool, lines ...string) *chat.Message {
+	var cards []*chat.CardWithId
+	for _, card := range msg.CardsV2 {
+		if card.Card == nil {
+			continue
+		}
+		updated := *card.Card
+		updated.Sections = nil
+		for _, section := range card.Card.Sections {
+			s := *section
+			s.Widgets = nil
+			for _, widget := range section.Widgets {
+				if done && widget.ButtonList != nil {
+					widget = withoutActions(widget)
+					if len(widget.ButtonList.Buttons) == 0 {
+						continue
+					}
+				}
+				s.Widgets = append(s.Widgets, widget)
+			}
+			if len(s.Widgets) > 0 {
+				updated.Sections = append(updated.Sections, &s)
+			}
+		}
+		cards = append(cards, &chat.CardWithId{CardId: card.CardId, Card: &updated})
+	}
+
+	if len(cards) > 0 {
+		last := cards[len(cards)-1].Card
+		section := &chat.GoogleAppsCardV1Section{}
+		for _, line := range lines {
+			section.Widgets = append(section.Widgets, &chat.GoogleAppsCardV1Widget{
+				TextParagraph: &chat.GoogleAppsCardV1TextParagraph{Text: line},
+			})
+		}
+		last.Sections = append(last.Sections, section)
+	}
+	return &chat.Message{CardsV2: cards}
+}
+
+// withoutActions keeps the buttons of widget which open links.
+func withoutActions(widget *chat.GoogleAppsCardV1Widget) *chat.GoogleAppsCardV1Widget {
+	list := &chat.GoogleAppsCardV1ButtonList{}
+	for _, button := range widget.ButtonList.Buttons {
+		if button.OnClick == nil || button.OnClick.Action == nil {
+			list.Buttons = append(list.Buttons, button)
+		}
+	}
+	return &chat.GoogleAppsCardV1Widget{ButtonList: list}
+}
+
+// cardText turns an outcome text into card markup, where users can't be
+// mentioned and links are HTML.
+func cardText(text string, user User) string {
+	name := user.Name
+	if name == "" {
+		name = user.ID
+	}
+	text = strings.ReplaceAll(text, user.Mention(), name)
+	text = link.ReplaceAllString(text, `<a href="$1">$2</a>`)
+	return bold.ReplaceAllString(text, `<b>$1</b>`)
+}
+
+func thread(event *chat.DeprecatedEvent) *chat.Thread {
+	if event.Message != nil && event.Message.Thread != nil {
+		return &chat.Thread{Name: event.Message.Thread.Name}
+	}
+	return event.Thread
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
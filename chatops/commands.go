@@ -0,0 +1,262 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+)
+
+// commandTimeout bounds the lookups of a command. Slack only waits 3 seconds
+// for an answer, so the result is posted to the command's response_url.
+const commandTimeout = 30 * time.Second
+
+// recentReleases is how many releases /deploy releases lists.
+const recentReleases = 10
+
+const usage = "Usage: `/deploy status|releases|targets <pipeline>`"
+
+// pipelineID matches the IDs Cloud Deploy allows, so what users type can't
+// name other resources once put in a resource name.
+var pipelineID = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+
+// Commands answers the /deploy Slack slash command:
+//
+//	/deploy status <pipeline>    the release running on each target
+//	/deploy releases <pipeline>  the latest releases
+//	/deploy targets <pipeline>   the targets in promotion order
+type Commands struct {
+	// SigningSecret is the Slack app's, to verify requests.
+	SigningSecret string
+	// Deploy looks up the pipelines.
+	Deploy *gcpclouddeploy.Client
+	// HTTPClient posts to response_url, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	running sync.WaitGroup
+}
+
+func (c *Commands) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := readSlackRequest(c.SigningSecret, w, r)
+	if !ok {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse command: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "received command", "command", form.Get("command"), "text", form.Get("text"), "user", form.Get("user_id"))
+
+	command, pipeline, answer := parseCommand(form.Get("text"))
+	if answer == nil {
+		// The lookups can take longer than Slack waits, so the answer is only
+		// that they started, and the result is posted afterwards.
+		answer = []bot.Block{section(fmt.Sprintf("⏳ Looking up `%s`…", pipeline))}
+		ctx := context.WithoutCancel(r.Context())
+		responseURL := form.Get("response_url")
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+			defer cancel()
+			ctx, span := tracing.Start(ctx, "deploybot.command")
+			defer span.End()
+
+			if err := postResponse(ctx, c.HTTPClient, responseURL, &bot.SlackMessageWrapper{
+				ResponseType:    "ephemeral",
+				ReplaceOriginal: true,
+				Blocks:          c.run(ctx, command, pipeline),
+			}); err != nil {
+				slog.ErrorContext(ctx, "could not post command result", "command", command, "error", err)
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&bot.SlackMessageWrapper{
+		ResponseType: "ephemeral",
+		Blocks:       answer,
+	})
+}
+
+// Wait waits for the commands being run until ctx is done, e.g. before the
+// server exits.
+func (c *Commands) Wait(ctx context.Context) error {
+	return waitFor(ctx, &c.running)
+}
+
+// parseCommand splits text into the command and its pipeline. When text
+// isn't a command, the answer telling so is returned instead.
+func parseCommand(text string) (string, string, []bot.Block) {
+	args := strings.Fields(text)
+	if len(args) != 2 {
+		return "", "", []bot.Block{section(usage)}
+	}
+	command, pipeline := args[0], args[1]
+	if !pipelineID.MatchString(pipeline) {
+		return "", "", []bot.Block{section(fmt.Sprintf("`%s` is not a pipeline ID. %s", pipeline, usage))}
+	}
+
+	switch command {
+	case "status", "releases", "targets":
+		return command, pipeline, nil
+	default:
+		return "", "", []bot.Block{section(fmt.Sprintf("Unknown command `%s`. %s", command, usage))}
+	}
+}
+
+// run executes command on pipeline and returns the answer.
+func (c *Commands) run(ctx context.Context, command string, pipeline string) []bot.Block {
+	var blocks []bot.Block
+	var err error
+	switch command {
+	case "status":
+		blocks, err = c.status(ctx, pipeline)
+	case "releases":
+		blocks, err = c.releases(ctx, pipeline)
+	case "targets":
+		blocks, err = c.targets(ctx, pipeline)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "command failed", "command", command, "pipeline", pipeline, "error", err)
+		return []bot.Block{section(fmt.Sprintf("⚠️ Could not look up `%s`: %v", pipeline, err))}
+	}
+	return blocks
+}
+
+func (c *Commands) status(ctx context.Context, pipeline string) ([]bot.Block, error) {
+	status, err := c.Deploy.Status(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []bot.Block{header(fmt.Sprintf("📦 %s status", pipeline))}
+	for _, target := range status {
+		release := "_nothing deployed recently_"
+		if target.Release != "" {
+			release = fmt.Sprintf("<%s|%s> ✅ %s", c.releaseLink(pipeline, target.Release), target.Release, target.DeployTime)
+		}
+		blocks = append(blocks, fields(
+			fmt.Sprintf("*Target:* <%s|%s>", c.targetLink(pipeline, target.TargetID), target.TargetID),
+			"*Release:* "+release,
+		))
+	}
+	return blocks, nil
+}
+
+func (c *Commands) releases(ctx context.Context, pipeline string) ([]bot.Block, error) {
+	releases, err := c.Deploy.Releases(ctx, pipeline, recentReleases)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, release := range releases {
+		id := gcpclouddeploy.ResourceID(release.Name)
+		line := fmt.Sprintf("• <%s|%s> created %s, render %s", c.releaseLink(pipeline, id), id, release.CreateTime, strings.ToLower(release.RenderState))
+		if release.Abandoned {
+			line += ", abandoned"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "_no releases yet_")
+	}
+
+	return []bot.Block{
+		header(fmt.Sprintf("📦 %s releases", pipeline)),
+		section(strings.Join(lines, "\n")),
+	}, nil
+}
+
+func (c *Commands) targets(ctx context.Context, pipeline string) ([]bot.Block, error) {
+	stages, err := c.Deploy.Stages(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for i, stage := range stages {
+		target, err := c.Deploy.Target(ctx, stage.TargetId)
+		if err != nil {
+			return nil, err
+		}
+		line := fmt.Sprintf("%d. <%s|%s>", i+1, c.targetLink(pipeline, stage.TargetId), stage.TargetId)
+		if target.Description != "" {
+			line += " — " + target.Description
+		}
+		if target.RequireApproval {
+			line += " 🔒 requires approval"
+		}
+		lines = append(lines, line)
+	}
+
+	return []bot.Block{
+		header(fmt.Sprintf("📦 %s targets", pipeline)),
+		section(strings.Join(lines, "\n")),
+	}, nil
+}
+
+func (c *Commands) consoleURL(pipeline string) string {
+	return fmt.Sprintf("https://console.cloud.google.com/deploy/delivery-pipelines/%s/%s/", c.Deploy.Location, pipeline)
+}
+
+func (c *Commands) releaseLink(pipeline string, release string) string {
+	return fmt.Sprintf("%sreleases/%s/rollouts?project=%s", c.consoleURL(pipeline), release, c.Deploy.Project)
+}
+
+func (c *Commands) targetLink(pipeline string, target string) string {
+	return fmt.Sprintf("%stargets/%s?project=%s", c.consoleURL(pipeline), target, c.Deploy.Project)
+}
+
+func header(text string) bot.Block {
+	return bot.Block{
+		TypeSectionBlock: "header",
+		Text:             &bot.TextBlock{TypeTextBlock: "plain_text", Text: text, Emoji: true},
+	}
+}
+
+func section(text string) bot.Block {
+	return bot.Block{
+		TypeSectionBlock: "section",
+		Text:             &bot.TextBlock{TypeTextBlock: "mrkdwn", Text: text},
+	}
+}
+
+func fields(texts ...string) bot.Block {
+	block := bot.Block{TypeSectionBlock: "section"}
+	for _, text := range texts {
+		block.Fields = append(block.Fields, bot.TextBlock{TypeTextBlock: "mrkdwn", Text: text})
+	}
+	return block
+}
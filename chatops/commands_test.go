@@ -0,0 +1,178 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy/fake"
+)
+
+const signingSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// slackRequest builds a request signed the way Slack does at time at.
+func slackRequest(method string, path string, body string, secret string, at time.Time) *http.Request {
+	timestamp := fmt.Sprint(at.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func testDeploy(t *testing.T) (*gcpclouddeploy.Client, *fake.Server) {
+	server := fake.NewServer()
+	t.Cleanup(server.Close)
+	server.AddSamplePipeline("projects/my-project/locations/us-central1")
+
+	return &gcpclouddeploy.Client{Project: "my-project", Location: "us-central1", Options: server.Options()}, server
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	at := time.Now()
+
+	var testTable = []struct {
+		name    string
+		request *http.Request
+		wantErr bool
+	}{
+		{"Valid", slackRequest("POST", "/", "text=status", signingSecret, at), false},
+		{"Wrong secret", slackRequest("POST", "/", "text=status", "other", at), true},
+		{"Replayed", slackRequest("POST", "/", "text=status", signingSecret, at.Add(-10*time.Minute)), true},
+		{"Unsigned", httptest.NewRequest("POST", "/", nil), true},
+	}
+
+	for _, test := range testTable {
+		err := VerifySlackSignature(signingSecret, test.request.Header, []byte("text=status"), at)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error %v, got: %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	deploy, _ := testDeploy(t)
+	posted := make(chan *bot.SlackMessageWrapper, 1)
+	responses := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := &bot.SlackMessageWrapper{}
+		json.NewDecoder(r.Body).Decode(msg)
+		posted <- msg
+	}))
+	defer responses.Close()
+	commands := &Commands{SigningSecret: signingSecret, Deploy: deploy}
+
+	var testTable = []struct {
+		text string
+		// lookup tells the result is posted to the response_url.
+		lookup bool
+		want   []string
+	}{
+		{"status web-app", true, []string{"web-app status", "*Target:* <", "|staging>", "|rel-2>", "|prod>", "|rel-1>"}},
+		{"releases web-app", true, []string{"web-app releases", "|rel-2> created 2021-06-02T10:00:00Z, render succeeded\n• <"}},
+		{"targets web-app", true, []string{"1. <", "|staging> — Staging cluster", "2. <", "|prod> — Production cluster 🔒 requires approval"}},
+		{"status", false, []string{usage}},
+		{"rollback web-app", false, []string{"Unknown command `rollback`"}},
+		{"status nope", true, []string{"Could not look up `nope`"}},
+		{"status web-app/releases/rel-1", false, []string{"`web-app/releases/rel-1` is not a pipeline ID", usage}},
+		{"releases ../..", false, []string{"`../..` is not a pipeline ID"}},
+		{"targets Web-App", false, []string{"`Web-App` is not a pipeline ID"}},
+	}
+
+	for _, test := range testTable {
+		body := url.Values{"command": {"/deploy"}, "text": {test.text}, "user_id": {"U123"}, "response_url": {responses.URL}}.Encode()
+		rec := httptest.NewRecorder()
+		commands.ServeHTTP(rec, slackRequest("POST", "/slack/commands", body, signingSecret, time.Now()))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: wanted status 200, got: %d", test.text, rec.Code)
+		}
+		answer := &bot.SlackMessageWrapper{}
+		if err := json.NewDecoder(rec.Body).Decode(answer); err != nil {
+			t.Fatalf("%s: could not decode answer: %v", test.text, err)
+		}
+		if test.lookup {
+			if len(answer.Blocks) != 1 || !strings.HasPrefix(answer.Blocks[0].Text.Text, "⏳ Looking up") {
+				t.Errorf("%s: wanted the lookup acknowledged, got: %+v", test.text, answer.Blocks)
+			}
+			commands.Wait(context.Background())
+			answer = <-posted
+			if !answer.ReplaceOriginal {
+				t.Errorf("%s: wanted the acknowledgement replaced", test.text)
+			}
+		}
+		if answer.ResponseType != "ephemeral" {
+			t.Errorf("%s: wanted an ephemeral answer, got: %q", test.text, answer.ResponseType)
+		}
+
+		b, _ := json.Marshal(answer.Blocks)
+		var text []string
+		for _, block := range answer.Blocks {
+			if block.Text != nil {
+				text = append(text, block.Text.Text)
+			}
+			for _, field := range block.Fields {
+				text = append(text, field.Text)
+			}
+		}
+		for _, want := range test.want {
+			if !strings.Contains(strings.Join(text, "\n"), want) {
+				t.Errorf("%s: wanted %q in %s", test.text, want, b)
+			}
+		}
+	}
+}
+
+func TestCommandsRejectUnsignedRequests(t *testing.T) {
+	deploy, server := testDeploy(t)
+	commands := &Commands{SigningSecret: signingSecret, Deploy: deploy}
+
+	var testTable = []struct {
+		request *http.Request
+		status  int
+	}{
+		{slackRequest("POST", "/", "text=status+web-app", "wrong", time.Now()), http.StatusUnauthorized},
+		{httptest.NewRequest("POST", "/", strings.NewReader("text=status+web-app")), http.StatusUnauthorized},
+		{httptest.NewRequest("GET", "/", nil), http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range testTable {
+		rec := httptest.NewRecorder()
+		commands.ServeHTTP(rec, test.request)
+		if rec.Code != test.status {
+			t.Errorf("wanted status %d, got: %d", test.status, rec.Code)
+		}
+	}
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("wanted no API calls, got: %v", calls)
+	}
+}
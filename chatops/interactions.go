@@ -0,0 +1,218 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+)
+
+// SlackInteractions handles clicks on the buttons of Slack messages, see
+// https://api.slack.com/interactivity/handling
+type SlackInteractions struct {
+	// SigningSecret is the Slack app's, to verify requests.
+	SigningSecret string
+	Actions       *Actions
+	// Replier posts the outcome in the thread of the message. Without one,
+	// or if it fails, the outcome goes to the interaction's response_url.
+	Replier bot.Replier
+	// HTTPClient posts to response_url, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	running sync.WaitGroup
+}
+
+// slackInteraction holds the fields of a block_actions payload the bot uses.
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Message struct {
+		TS       string            `json:"ts"`
+		ThreadTS string            `json:"thread_ts"`
+		Blocks   []json.RawMessage `json:"blocks"`
+	} `json:"message"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+func (s *SlackInteractions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := readSlackRequest(s.SigningSecret, w, r)
+	if !ok {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse interaction: %v", err), http.StatusBadRequest)
+		return
+	}
+	payload := &slackInteraction{}
+	if err := json.Unmarshal([]byte(form.Get("payload")), payload); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode interaction payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Other interactions, e.g. with shortcuts, aren't used by the bot.
+	if payload.Type != "block_actions" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Slack only waits 3 seconds for the answer, which is too short for some
+	// actions, so they are taken afterwards and their outcome is posted. The
+	// request ending mustn't cancel them half way.
+	ctx := context.WithoutCancel(r.Context())
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		ctx, cancel := context.WithTimeout(ctx, actionTimeout)
+		defer cancel()
+		s.act(ctx, payload)
+	}()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// act takes the actions of payload, then updates the message and posts the
+// outcome.
+func (s *SlackInteractions) act(ctx context.Context, payload *slackInteraction) {
+	user := User{Platform: "slack", ID: payload.User.ID, Name: payload.User.Username}
+	thread := payload.Message.ThreadTS
+	if thread == "" {
+		thread = payload.Message.TS
+	}
+
+	for _, action := range payload.Actions {
+		v, err := bot.ParseActionValue(action.Value)
+		if err != nil {
+			slog.WarnContext(ctx, "ignoring Slack action", "action", action.ActionID, "error", err)
+			continue
+		}
+
+		text, entry, err := s.Actions.Run(ctx, user, v, Thread{Channel: payload.Channel.ID, Name: thread})
+		if err != nil {
+			text = failure(v, err)
+			// The buttons stay so the action can be tried again.
+			s.update(ctx, payload, false, entry.Summary())
+		} else {
+			s.update(ctx, payload, true, text, entry.Summary())
+		}
+		s.reply(ctx, payload, thread, text)
+	}
+}
+
+// Wait waits for the actions being taken until ctx is done, e.g. before the
+// server exits.
+func (s *SlackInteractions) Wait(ctx context.Context) error {
+	return waitFor(ctx, &s.running)
+}
+
+// reply posts text in thread, or with the response_url of the payload.
+func (s *SlackInteractions) reply(ctx context.Context, payload *slackInteraction, thread string, text string) {
+	if s.Replier != nil {
+		err := s.Replier.Reply(ctx, payload.Channel.ID, thread, text)
+		if err == nil {
+			return
+		}
+		slog.WarnContext(ctx, "could not reply in thread, using response_url", "error", err)
+	}
+
+	if err := postResponse(ctx, s.HTTPClient, payload.ResponseURL, map[string]interface{}{
+		"text":             text,
+		"response_type":    "in_channel",
+		"replace_original": false,
+	}); err != nil {
+		slog.ErrorContext(ctx, "could not post action outcome", "error", err)
+	}
+}
+
+// update adds lines under the message as context blocks. When the action is
+// done its buttons are removed too, so it shows the new state and the action
+// isn't taken twice.
+func (s *SlackInteractions) update(ctx context.Context, payload *slackInteraction, done bool, lines ...string) {
+	if payload.ResponseURL == "" {
+		return
+	}
+
+	var blocks []interface{}
+	for _, block := range payload.Message.Blocks {
+		var b struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(block, &b); err != nil || (done && b.Type == "actions") {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	for _, line := range lines {
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "context",
+			"elements": []bot.TextBlock{{TypeTextBlock: "mrkdwn", Text: line}},
+		})
+	}
+
+	if err := postResponse(ctx, s.HTTPClient, payload.ResponseURL, map[string]interface{}{
+		"blocks":           blocks,
+		"replace_original": true,
+	}); err != nil {
+		slog.WarnContext(ctx, "could not update message", "error", err)
+	}
+}
+
+// postResponse posts msg to a Slack response_url.
+func postResponse(ctx context.Context, client *http.Client, responseURL string, msg interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request was not ok: %v", resp.StatusCode)
+	}
+	return nil
+}
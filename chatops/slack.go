@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chatops lets chat users query and drive Cloud Deploy pipelines, with
+// Slack slash commands and interactive messages.
+package chatops
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRequestAge rejects Slack requests replayed later on.
+const maxRequestAge = 5 * time.Minute
+
+// maxBodySize is well above what Slack sends.
+const maxBodySize = 1 << 20
+
+// now is replaced by tests.
+var now = time.Now
+
+// VerifySlackSignature checks body was signed with secret at the time given in
+// header, see https://api.slack.com/authentication/verifying-requests-from-slack
+func VerifySlackSignature(secret string, header http.Header, body []byte, at time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed request timestamp")
+	}
+	if age := at.Sub(time.Unix(seconds, 0)); age > maxRequestAge || age < -maxRequestAge {
+		return fmt.Errorf("request timestamp is %v off", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(header.Get("X-Slack-Signature")), []byte(want)) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// readSlackRequest reads the body of r once its signature is verified.
+func readSlackRequest(secret string, w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read request: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	if err := VerifySlackSignature(secret, r.Header, body, now()); err != nil {
+		http.Error(w, fmt.Sprintf("unauthenticated: %v", err), http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command deploybot-pull consumes Cloud Deploy notifications from a Pub/Sub
+// subscription with streaming pull, e.g. on GKE or VMs. It is configured with
+// the same environment variables as the Cloud Function, plus:
+//
+//	SUBSCRIPTION                   full name of the subscription, i.e.
+//	                               projects/PROJECT/subscriptions/NAME.
+//	PULL_STREAMS                   number of streaming pull connections.
+//	PULL_MAX_OUTSTANDING_MESSAGES  messages processed at once.
+//	PULL_MAX_OUTSTANDING_BYTES     bytes of messages processed at once.
+//
+// Set PUBSUB_EMULATOR_HOST to run against the Pub/Sub emulator.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	deploybot "github.com/GoogleCloudPlatform/cloud-deploy-chatbot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/config"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/logging"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/pull"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+)
+
+func main() {
+	subscription := os.Getenv("SUBSCRIPTION")
+	parts := strings.Split(subscription, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "subscriptions" {
+		logging.Fatalf("please define the SUBSCRIPTION env var as projects/PROJECT/subscriptions/NAME")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		logging.Fatalf("invalid configuration: %v", err)
+	}
+	notifier, err := deploybot.NewNotifier(cfg)
+	if err != nil {
+		logging.Fatalf("could not create notifier: %v", err)
+	}
+
+	settings := pull.Settings{
+		Streams:                intEnv("PULL_STREAMS"),
+		MaxOutstandingMessages: intEnv("PULL_MAX_OUTSTANDING_MESSAGES"),
+		MaxOutstandingBytes:    intEnv("PULL_MAX_OUTSTANDING_BYTES"),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	client, err := pubsub.NewClient(ctx, parts[1])
+	if err != nil {
+		logging.Fatalf("could not create Pub/Sub client: %v", err)
+	}
+	defer client.Close()
+
+	slog.Info("receiving", "subscription", subscription)
+
+	// Receive returns once ctx is done and the messages being processed are
+	// acked or nacked.
+	err = pull.Receive(ctx, client.Subscriber(subscription), settings, notifier.Process)
+	if err != nil {
+		logging.Fatalf("receive failed: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		slog.Error("could not export the last spans", "error", err)
+	}
+	slog.Info("shut down")
+}
+
+func intEnv(name string) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logging.Fatalf("%s is not a number: %v", name, err)
+	}
+	return i
+}
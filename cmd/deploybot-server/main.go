@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command deploybot-server receives Cloud Deploy notifications from a Pub/Sub
+// push subscription, e.g. when running on Cloud Run, and serves Prometheus
+// metrics on /metrics. When SLACK_SIGNING_SECRET is set it also answers the
+// /deploy Slack command on /slack/commands, and the buttons of messages on
+// /slack/interactions. With CHAT_ACTIONS and Google Chat, the buttons are
+// handled on /chat/events. It is configured with the same environment
+// variables as the Cloud Function, plus:
+//
+//	PORT                  port to listen on, 8080 by default.
+//	PUSH_SERVICE_ACCOUNT  email of the service account the subscription pushes as.
+//	PUSH_AUDIENCE         audience of the push tokens, the request URL by default.
+//	PUSH_JWKS             URL or file of the token signing keys, Google's by default.
+//	PUSH_AUTH_DISABLED    set to true when something else, e.g. Cloud Run IAM,
+//	                      already authenticates the requests.
+//	CHAT_AUDIENCE         the HTTP endpoint URL of the Google Chat app, which
+//	                      its requests are authenticated with.
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	deploybot "github.com/GoogleCloudPlatform/cloud-deploy-chatbot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/audit"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/chatops"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/config"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/logging"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/metrics"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/push"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"google.golang.org/api/option"
+)
+
+// shutdownTimeout leaves in-flight messages time to be posted. Cloud Run
+// waits 10 seconds after SIGTERM before killing the instance.
+const shutdownTimeout = 8 * time.Second
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		logging.Fatalf("invalid configuration: %v", err)
+	}
+	notifier, err := deploybot.NewNotifier(cfg)
+	if err != nil {
+		logging.Fatalf("could not create notifier: %v", err)
+	}
+
+	handler := push.Handler(notifier.Process)
+	if os.Getenv("PUSH_AUTH_DISABLED") != "true" {
+		handler = verifier().Authenticate(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle("/metrics", metrics.Handler())
+	deploy := &gcpclouddeploy.Client{Project: cfg.Project, Location: cfg.Location}
+	sink, closeAudit := auditSink(cfg)
+	defer closeAudit()
+	actions := &chatops.Actions{Deploy: deploy, Policy: cfg.Policy, Replier: notifier, Audit: sink}
+	commands := &chatops.Commands{SigningSecret: cfg.SlackSigningSecret, Deploy: deploy}
+	interactions := &chatops.SlackInteractions{SigningSecret: cfg.SlackSigningSecret, Actions: actions, Replier: notifier}
+	if cfg.SlackSigningSecret != "" {
+		mux.Handle("/slack/commands", commands)
+		mux.Handle("/slack/interactions", interactions)
+	}
+	if cfg.Actions && cfg.Adapter() == "google" {
+		chat := &chatops.ChatEvents{Actions: actions, Replier: notifier, Updater: notifier}
+		mux.Handle("/chat/events", chatVerifier().Authenticate(chat))
+	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go func() {
+		slog.Info("listening", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatalf("server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logging.Fatalf("could not shut down gracefully: %v", err)
+	}
+	// The Slack commands and actions, and the rollbacks being followed,
+	// outlive their request.
+	if err := commands.Wait(shutdownCtx); err != nil {
+		slog.Error("could not finish the Slack commands", "error", err)
+	}
+	if err := interactions.Wait(shutdownCtx); err != nil {
+		slog.Error("could not finish the Slack actions", "error", err)
+	}
+	if err := actions.Close(shutdownCtx); err != nil {
+		slog.Error("could not stop following the rollouts", "error", err)
+	}
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		slog.Error("could not export the last spans", "error", err)
+	}
+}
+
+// auditSink records the chat actions in the log, plus the audit file and
+// BigQuery table if set. The returned func closes the file.
+func auditSink(cfg *config.Config) (audit.Sink, func()) {
+	sinks := audit.Multi{audit.Log}
+	closeAudit := func() {}
+
+	if cfg.AuditFile != "" {
+		file, err := audit.OpenFile(cfg.AuditFile)
+		if err != nil {
+			logging.Fatalf("%v", err)
+		}
+		sinks = append(sinks, file)
+		closeAudit = func() {
+			if err := file.Close(); err != nil {
+				slog.Error("could not close audit file", "error", err)
+			}
+		}
+	}
+	if cfg.AuditTable != "" {
+		bq := &audit.BigQuery{Table: cfg.AuditTable}
+		if cfg.AuditEndpoint != "" {
+			bq.Options = []option.ClientOption{option.WithEndpoint(cfg.AuditEndpoint), option.WithoutAuthentication()}
+		}
+		sinks = append(sinks, bq)
+	}
+	return sinks, closeAudit
+}
+
+// chatVerifier checks requests come from Google Chat.
+func chatVerifier() *push.Verifier {
+	audience := os.Getenv("CHAT_AUDIENCE")
+	if audience == "" {
+		logging.Fatalf("please define the CHAT_AUDIENCE env var to handle Google Chat actions")
+	}
+	return &push.Verifier{
+		Audience: audience,
+		Email:    chatops.ChatSender,
+		Keys:     &push.JWKS{URL: push.GoogleJWKS},
+	}
+}
+
+// verifier checks push requests come from our subscription.
+func verifier() *push.Verifier {
+	email := os.Getenv("PUSH_SERVICE_ACCOUNT")
+	if email == "" {
+		logging.Fatalf("please define the PUSH_SERVICE_ACCOUNT env var, or set PUSH_AUTH_DISABLED to true")
+	}
+
+	keys := &push.JWKS{URL: push.GoogleJWKS}
+	if jwks := os.Getenv("PUSH_JWKS"); strings.HasPrefix(jwks, "https://") || strings.HasPrefix(jwks, "http://") {
+		keys = &push.JWKS{URL: jwks}
+	} else if jwks != "" {
+		keys = &push.JWKS{File: jwks}
+	}
+
+	return &push.Verifier{
+		Audience: os.Getenv("PUSH_AUDIENCE"),
+		Email:    email,
+		Keys:     keys,
+	}
+}
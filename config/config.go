@@ -0,0 +1,325 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads and validates the bot's settings from the environment
+// and/or a JSON file.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/audit"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/policy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/secrets"
+)
+
+// Config holds everything needed to build the bot.
+type Config struct {
+	// ChatApp names the adapter to use, "slack" by default.
+	ChatApp string `json:"chatApp,omitempty"`
+	// Token is Slack's bot token, Google Chat's Service Account Key JSON data
+	// or a webhook URL depending on ChatApp. It can also be a Secret Manager
+	// reference, sm://projects/PROJECT/secrets/NAME/versions/latest, which
+	// Resolve replaces with the secret's value.
+	Token string `json:"token,omitempty"`
+	// TokenSecret is the reference Token was resolved from, if any.
+	TokenSecret string `json:"-"`
+	// TokenRefresh is how often TokenSecret is read again to pick up rotated
+	// tokens, 10 minutes by default.
+	TokenRefresh Duration `json:"tokenRefresh,omitempty"`
+	// Channel is Slack's channel id or Google Chat's space id.
+	Channel string `json:"channel,omitempty"`
+	// SlackWebhookURL posts to a Slack incoming webhook instead of using Token.
+	SlackWebhookURL string `json:"slackWebhookUrl,omitempty"`
+	// ThreadByRelease groups the messages about a release in one thread.
+	ThreadByRelease bool `json:"threadByRelease,omitempty"`
+	// CardsV1 posts Google Chat's deprecated Cards v1.
+	CardsV1 bool `json:"cardsV1,omitempty"`
+	// MaxEventAge drops events older than this instead of posting them late.
+	// Zero means events never go stale.
+	MaxEventAge Duration `json:"maxEventAge,omitempty"`
+	// Enrich adds the release details read from the Cloud Deploy API, e.g. the
+	// images and annotations, to the notifications.
+	Enrich bool `json:"enrich,omitempty"`
+	// Options holds settings for adapters registered by other modules.
+	Options map[string]string `json:"options,omitempty"`
+
+	// Project and Location hold the pipelines the chat commands look up.
+	Project  string `json:"project,omitempty"`
+	Location string `json:"location,omitempty"`
+	// SlackSigningSecret enables the Slack commands, whose requests it
+	// verifies. It can be a Secret Manager reference like Token.
+	SlackSigningSecret string `json:"slackSigningSecret,omitempty"`
+	// Actions adds buttons to the messages to act on rollouts, e.g. promote
+	// them. They are handled by deploybot-server.
+	Actions bool `json:"actions,omitempty"`
+	// Policy decides which chat users may take the actions. Without one they
+	// are all denied.
+	Policy *policy.Policy `json:"policy,omitempty"`
+	// AuditFile is a local file the actions are appended to as JSON lines,
+	// besides the log.
+	AuditFile string `json:"auditFile,omitempty"`
+	// AuditTable is a BigQuery table, PROJECT.DATASET.TABLE, the actions are
+	// streamed into, and AuditEndpoint the API endpoint to use, e.g. an
+	// emulator's.
+	AuditTable    string `json:"auditTable,omitempty"`
+	AuditEndpoint string `json:"auditEndpoint,omitempty"`
+
+	// source is where TokenSecret was resolved.
+	source secrets.Source
+}
+
+// defaultTokenRefresh is used when TokenRefresh isn't set.
+const defaultTokenRefresh = 10 * time.Minute
+
+// Duration is a time.Duration written as "30m" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string such as \"30m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Load reads the JSON file named by DEPLOYBOT_CONFIG, if any, then overrides
+// it with the environment variables that are set, resolves a Token stored in
+// Secret Manager and validates the result.
+func Load() (*Config, error) {
+	c := &Config{}
+
+	if file := os.Getenv("DEPLOYBOT_CONFIG"); file != "" {
+		var err error
+		c, err = FromFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Resolve(ctx, &secrets.SecretManager{}); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FromFile reads a JSON config file. The result is not validated.
+func FromFile(name string) (*Config, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+
+	c := &Config{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("could not parse config %s: %v", name, err)
+	}
+	return c, nil
+}
+
+// applyEnv overrides c with the environment variables found by lookup.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+
+	str := func(name string, field *string) {
+		if value, ok := lookup(name); ok {
+			*field = value
+		}
+	}
+	boolean := func(name string, field *bool) {
+		if value, ok := lookup(name); ok {
+			*field = value == "true"
+		}
+	}
+	duration := func(name string, field *Duration) {
+		if value, ok := lookup(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s is not a valid duration: %v", name, err))
+			}
+			*field = Duration(d)
+		}
+	}
+
+	str("CHATAPP", &c.ChatApp)
+	str("TOKEN", &c.Token)
+	str("CHANNEL", &c.Channel)
+	str("SLACK_WEBHOOK_URL", &c.SlackWebhookURL)
+	duration("TOKEN_REFRESH", &c.TokenRefresh)
+	boolean("THREAD_BY_RELEASE", &c.ThreadByRelease)
+	boolean("GCHAT_CARDS_V1", &c.CardsV1)
+	duration("MAX_EVENT_AGE", &c.MaxEventAge)
+	boolean("ENRICH_NOTIFICATIONS", &c.Enrich)
+	str("DEPLOY_PROJECT", &c.Project)
+	str("DEPLOY_LOCATION", &c.Location)
+	str("SLACK_SIGNING_SECRET", &c.SlackSigningSecret)
+	boolean("CHAT_ACTIONS", &c.Actions)
+	str("AUDIT_FILE", &c.AuditFile)
+	str("AUDIT_BIGQUERY_TABLE", &c.AuditTable)
+	str("AUDIT_BIGQUERY_ENDPOINT", &c.AuditEndpoint)
+
+	return errors.Join(errs...)
+}
+
+// Resolve replaces a Token or SlackSigningSecret referring to a secret with
+// the secret's value read from src, which is kept to refresh the token later.
+func (c *Config) Resolve(ctx context.Context, src secrets.Source) error {
+	if secrets.IsReference(c.SlackSigningSecret) {
+		value, err := src.Access(ctx, c.SlackSigningSecret)
+		if err != nil {
+			return fmt.Errorf("could not resolve slackSigningSecret: %v", err)
+		}
+		c.SlackSigningSecret = value
+	}
+
+	if !secrets.IsReference(c.Token) {
+		return nil
+	}
+
+	value, err := src.Access(ctx, c.Token)
+	if err != nil {
+		return fmt.Errorf("could not resolve token: %v", err)
+	}
+
+	c.TokenSecret, c.Token, c.source = c.Token, value, src
+	return nil
+}
+
+// RefreshInterval is how often TokenSecret should be read again, or zero when
+// Token didn't come from a secret.
+func (c *Config) RefreshInterval() time.Duration {
+	if c.TokenSecret == "" {
+		return 0
+	}
+	if c.TokenRefresh > 0 {
+		return time.Duration(c.TokenRefresh)
+	}
+	return defaultTokenRefresh
+}
+
+// LatestToken reads the current value of TokenSecret.
+func (c *Config) LatestToken(ctx context.Context) (string, error) {
+	if c.TokenSecret == "" || c.source == nil {
+		return c.Token, nil
+	}
+	return c.source.Access(ctx, c.TokenSecret)
+}
+
+// Validate checks every setting and reports all the problems at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	// The adapter checks the settings it needs.
+	if _, err := bot.New(c.Adapter(), c.settings()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.MaxEventAge < 0 {
+		errs = append(errs, errors.New("maxEventAge can't be negative"))
+	}
+	if c.TokenRefresh < 0 {
+		errs = append(errs, errors.New("tokenRefresh can't be negative"))
+	}
+	if secrets.IsReference(c.Token) {
+		errs = append(errs, errors.New("token refers to a secret which wasn't resolved"))
+	}
+	if secrets.IsReference(c.SlackSigningSecret) {
+		errs = append(errs, errors.New("slackSigningSecret refers to a secret which wasn't resolved"))
+	}
+	if c.SlackSigningSecret != "" && (c.Project == "" || c.Location == "") {
+		errs = append(errs, errors.New("project and location are needed for the Slack commands"))
+	}
+	if c.Actions && (c.Project == "" || c.Location == "") {
+		errs = append(errs, errors.New("project and location are needed for the chat actions"))
+	}
+	if c.ThreadByRelease && c.Adapter() == "slack" && (c.SlackWebhookURL != "" || bot.IsSlackWebhook(c.Token)) {
+		errs = append(errs, errors.New("threadByRelease can't be used with a Slack webhook, which can't reply in threads"))
+	}
+	if c.Actions && c.Adapter() == "slack" && c.SlackSigningSecret == "" {
+		errs = append(errs, errors.New("slackSigningSecret is needed for the Slack actions"))
+	}
+	if c.Actions && c.CardsV1 {
+		errs = append(errs, errors.New("actions need Google Chat Cards v2"))
+	}
+	if c.Policy != nil {
+		if err := c.Policy.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.AuditTable != "" {
+		if _, _, _, err := audit.ParseTable(c.AuditTable); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.AuditEndpoint != "" && c.AuditTable == "" {
+		errs = append(errs, errors.New("auditEndpoint needs an auditTable"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewBot builds the adapter registered under ChatApp, see bot.Register.
+func (c *Config) NewBot() (bot.Bot, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return bot.New(c.Adapter(), c.settings())
+}
+
+func (c *Config) settings() bot.Settings {
+	return bot.Settings{
+		Token:           c.Token,
+		Channel:         c.Channel,
+		WebhookURL:      c.SlackWebhookURL,
+		ThreadByRelease: c.ThreadByRelease,
+		CardsV1:         c.CardsV1,
+		Actions:         c.Actions,
+		Options:         c.Options,
+	}
+}
+
+// Adapter is the name of the adapter ChatApp picks.
+func (c *Config) Adapter() string {
+	if c.ChatApp == "" {
+		return "slack" // Slack by default
+	}
+	return c.ChatApp
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/secrets"
+)
+
+// lookup fakes os.LookupEnv with env.
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestConfigs(t *testing.T) {
+	tests := []struct {
+		env    map[string]string
+		errors []string
+		bot    bot.Bot
+	}{
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123"},
+			nil,
+			&bot.SlackAdapter{},
+		},
+		{
+			map[string]string{"TOKEN": "https://hooks.slack.com/services/T/B/X"},
+			nil,
+			&bot.SlackAdapter{},
+		},
+		{
+			map[string]string{"TOKEN": "https://hooks.slack.com/services/T/B/X", "THREAD_BY_RELEASE": "true"},
+			[]string{"threadByRelease can't be used with a Slack webhook"},
+			nil,
+		},
+		{
+			map[string]string{"SLACK_WEBHOOK_URL": "https://hooks.slack.com/services/T/B/X", "THREAD_BY_RELEASE": "true"},
+			[]string{"threadByRelease can't be used with a Slack webhook"},
+			nil,
+		},
+		{
+			map[string]string{"CHATAPP": "google", "CHANNEL": "AAAA", "TOKEN": "", "GCHAT_CARDS_V1": "true"},
+			nil,
+			&bot.GChatAdapter{},
+		},
+		{
+			map[string]string{"CHATAPP": "google-webhook", "TOKEN": "https://chat.googleapis.com/v1/spaces/AAAA/messages?key=k"},
+			nil,
+			&bot.GChatWebhookAdapter{},
+		},
+		{
+			map[string]string{"CHATAPP": "slack"},
+			[]string{"token is required", "channel is required"},
+			nil,
+		},
+		{
+			map[string]string{"CHATAPP": "gogle", "MAX_EVENT_AGE": "soon"},
+			[]string{`unknown chat app "gogle"`, "google, google-webhook, slack", "MAX_EVENT_AGE is not a valid duration"},
+			nil,
+		},
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123", "SLACK_SIGNING_SECRET": "s3cr3t", "DEPLOY_PROJECT": "my-project", "DEPLOY_LOCATION": "us-central1"},
+			nil,
+			&bot.SlackAdapter{},
+		},
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123", "SLACK_SIGNING_SECRET": "s3cr3t"},
+			[]string{"project and location are needed"},
+			nil,
+		},
+		{
+			map[string]string{"CHATAPP": "google", "TOKEN": "{not json", "CHANNEL": "AAAA", "CHAT_ACTIONS": "true", "GCHAT_CARDS_V1": "true"},
+			[]string{"actions need Google Chat Cards v2", "project and location are needed for the chat actions"},
+			nil,
+		},
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123", "CHAT_ACTIONS": "true", "DEPLOY_PROJECT": "my-project", "DEPLOY_LOCATION": "us-central1"},
+			[]string{"slackSigningSecret is needed for the Slack actions"},
+			nil,
+		},
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123", "CHAT_ACTIONS": "true", "SLACK_SIGNING_SECRET": "s3cr3t", "DEPLOY_PROJECT": "my-project", "DEPLOY_LOCATION": "us-central1"},
+			nil,
+			&bot.SlackAdapter{},
+		},
+		{
+			map[string]string{"TOKEN": "xoxb-1", "CHANNEL": "C123", "AUDIT_BIGQUERY_TABLE": "my-project.audit", "AUDIT_FILE": "audit.jsonl"},
+			[]string{`audit table "my-project.audit" should look like PROJECT.DATASET.TABLE`},
+			nil,
+		},
+		{
+			map[string]string{"CHATAPP": "google", "TOKEN": "{not json"},
+			[]string{"channel is required for google", "token is not a valid Service Account Key"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		c := &Config{}
+		err := errors.Join(c.applyEnv(lookup(test.env)), c.Validate())
+
+		for _, want := range test.errors {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%v: wanted error containing %q, got: %v", test.env, want, err)
+			}
+		}
+		if test.errors != nil {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.env, err)
+			continue
+		}
+
+		b, err := c.NewBot()
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.env, err)
+			continue
+		}
+		if got, want := reflect.TypeOf(b), reflect.TypeOf(test.bot); got != want {
+			t.Errorf("%v: wanted a %v, got: %v", test.env, want, got)
+		}
+	}
+}
+
+func TestFileAndEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deploybot.json")
+	err := os.WriteFile(file, []byte(`{"chatApp": "slack", "token": "xoxb-file", "channel": "C-file", "maxEventAge": "30m"}`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	c, err := FromFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.applyEnv(lookup(map[string]string{"CHANNEL": "C-env"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.Token != "xoxb-file" || c.Channel != "C-env" {
+		t.Errorf("wanted the env to override the file, got: %+v", c)
+	}
+	if time.Duration(c.MaxEventAge) != 30*time.Minute {
+		t.Errorf("wanted maxEventAge of 30m, got: %v", time.Duration(c.MaxEventAge))
+	}
+}
+
+func TestPolicyFromFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deploybot.json")
+	err := os.WriteFile(file, []byte(`{"token": "xoxb-file", "channel": "C123", "policy": {
+		"users": {"U0123ABCD": "user:alice@example.com"},
+		"rules": [{"principals": ["user:alice@example.com"], "targets": ["prod"], "actions": ["promote", "approve"]}]
+	}}`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	c, err := FromFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Policy == nil || c.Policy.Users["U0123ABCD"] != "user:alice@example.com" {
+		t.Errorf("wanted the policy from the file, got: %+v", c.Policy)
+	}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), `unknown action "approve"`) {
+		t.Errorf("wanted the policy to be validated, got: %v", err)
+	}
+}
+
+func TestLoadUsesEnvironment(t *testing.T) {
+	t.Setenv("DEPLOYBOT_CONFIG", "")
+	t.Setenv("CHATAPP", "slack")
+	t.Setenv("TOKEN", "xoxb-1")
+	t.Setenv("CHANNEL", "C123")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Channel != "C123" {
+		t.Errorf("wanted channel from the environment, got: %s", c.Channel)
+	}
+
+	t.Setenv("CHATAPP", "teams")
+	if _, err := Load(); err == nil {
+		t.Errorf("wanted an error for an unknown chat app")
+	}
+}
+
+func TestResolveSecretToken(t *testing.T) {
+	const ref = "sm://projects/myproject/secrets/slack-token/versions/latest"
+	src := &secrets.Memory{}
+	src.Set(ref, "xoxb-secret")
+
+	c := &Config{Token: ref, Channel: "C123"}
+	if err := c.Validate(); err == nil {
+		t.Errorf("wanted an error for an unresolved secret")
+	}
+
+	if err := c.Resolve(context.Background(), src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Token != "xoxb-secret" || c.TokenSecret != ref {
+		t.Errorf("wanted the token resolved from %s, got: %+v", ref, c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c.RefreshInterval() != defaultTokenRefresh {
+		t.Errorf("wanted the default refresh interval, got: %v", c.RefreshInterval())
+	}
+
+	src.Set(ref, "xoxb-rotated")
+	if token, err := c.LatestToken(context.Background()); err != nil || token != "xoxb-rotated" {
+		t.Errorf("wanted the rotated token, got: %s %v", token, err)
+	}
+
+	missing := &Config{Token: "sm://projects/myproject/secrets/nope/versions/latest"}
+	if err := missing.Resolve(context.Background(), src); err == nil {
+		t.Errorf("wanted an error for a missing secret")
+	}
+}
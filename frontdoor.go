@@ -19,59 +19,296 @@ package deploybot
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
-	"strings"
+	"log/slog"
+	"sync"
+	"time"
 
+	"cloud.google.com/go/functions/metadata"
 	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/config"
 	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/logging"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/metrics"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/chat/v1"
 )
 
-var (
-	chatToken string
-	channel   string
-	chatApp   string
-	theBot    bot.Bot
-)
+// Notifier posts Cloud Deploy notifications to the chat app picked by its Config.
+type Notifier struct {
+	// mu guards the config and bot, which are swapped when the token in
+	// Secret Manager is rotated.
+	mu        sync.RWMutex
+	cfg       *config.Config
+	bot       bot.Bot
+	refreshed time.Time
+	// enricher adds the release details to the messages, if enabled.
+	enricher *gcpclouddeploy.Enricher
+}
 
-// init is used to make it easier to access secrets and to adapt the code
-// to use other chat apps.
-func init() {
+// enrichTimeout bounds the Cloud Deploy API calls made for a notification,
+// which is posted without the release details if they take longer.
+const enrichTimeout = 5 * time.Second
+
+// NewNotifier builds a Notifier, validating cfg first.
+func NewNotifier(cfg *config.Config) (*Notifier, error) {
+	theBot, err := cfg.NewBot()
+	if err != nil {
+		return nil, err
+	}
+	n := &Notifier{cfg: cfg, bot: theBot, refreshed: time.Now()}
+	if cfg.Enrich {
+		n.enricher = &gcpclouddeploy.Enricher{Client: &gcpclouddeploy.Client{}}
+	}
+	return n, nil
+}
 
-	var found, found2, found3 bool
+// current returns the config and bot to use, first rebuilding the bot if the
+// token comes from a secret which has changed since it was last read.
+func (n *Notifier) current(ctx context.Context) (*config.Config, bot.Bot) {
+	n.mu.RLock()
+	cfg, theBot, refreshed := n.cfg, n.bot, n.refreshed
+	n.mu.RUnlock()
 
-	chatToken, found = os.LookupEnv("TOKEN")
-	channel, found2 = os.LookupEnv("CHANNEL")
-	if !found || !found2 {
-		log.Fatalf("please define the TOKEN and CHANNEL env vars")
+	interval := cfg.RefreshInterval()
+	if interval == 0 || time.Since(refreshed) < interval {
+		return cfg, theBot
 	}
 
-	// Customise this with your own chat app implementation if not using Slack or Google Chat.
-	chatApp, found3 = os.LookupEnv("CHATAPP")
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	if !found3 || chatApp == "slack" { // Slack by default
-		theBot = &bot.SlackAdapter{BotToken: chatToken}
+	// Another message may have refreshed it while we waited for the lock.
+	if n.refreshed != refreshed {
+		return n.cfg, n.bot
 	}
-	if chatApp == "google" {
-		theBot = &bot.GChatAdapter{BotToken: chatToken}
+	n.refreshed = time.Now()
+
+	token, err := cfg.LatestToken(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "could not refresh token, keeping the current one", "error", err)
+		return n.cfg, n.bot
+	}
+	if token == cfg.Token {
+		return n.cfg, n.bot
+	}
+
+	rotated := *cfg
+	rotated.Token = token
+	newBot, err := rotated.NewBot()
+	if err != nil {
+		slog.ErrorContext(ctx, "rotated token is not valid, keeping the current one", "error", err)
+		return n.cfg, n.bot
 	}
+
+	slog.InfoContext(ctx, "token was rotated")
+	n.cfg, n.bot = &rotated, newBot
+	return n.cfg, n.bot
+}
+
+// Reply posts text in a thread of the channel, using the current bot. It
+// implements bot.Replier for the chat actions.
+func (n *Notifier) Reply(ctx context.Context, channel string, thread string, text string) error {
+	_, theBot := n.current(ctx)
+	replier, ok := theBot.(bot.Replier)
+	if !ok {
+		return fmt.Errorf("%T can't reply in threads", theBot)
+	}
+	return replier.Reply(ctx, channel, thread, text)
+}
+
+// UpdateChatMessage replaces the cards of a Google Chat message, using the
+// current bot. It implements bot.ChatUpdater for the chat actions.
+func (n *Notifier) UpdateChatMessage(ctx context.Context, name string, msg *chat.Message) error {
+	_, theBot := n.current(ctx)
+	updater, ok := theBot.(bot.ChatUpdater)
+	if !ok {
+		return fmt.Errorf("%T can't update Google Chat messages", theBot)
+	}
+	return updater.UpdateChatMessage(ctx, name, msg)
+}
+
+var (
+	defaultOnce     sync.Once
+	defaultNotifier *Notifier
+	defaultErr      error
+)
+
+// notifier returns the Notifier used by the Cloud Function entry points, built
+// from the environment on first use.
+func notifier() (*Notifier, error) {
+	defaultOnce.Do(func() {
+		var cfg *config.Config
+		cfg, defaultErr = config.Load()
+		if defaultErr == nil {
+			defaultNotifier, defaultErr = NewNotifier(cfg)
+		}
+	})
+	return defaultNotifier, defaultErr
+}
+
+// init sets up Cloud Logging and tracing, and registers the CloudEvents entry
+// point with the Functions Framework. The configuration is only loaded on
+// first use, so a bad one is reported in the logs rather than crashing the
+// function.
+func init() {
+	logging.Setup()
+	if err := tracing.Setup(context.Background()); err != nil {
+		slog.Error("could not set up tracing", "error", err)
+	}
+	functions.CloudEvent("CloudEventPubSubCDOps", CloudEventPubSubCDOps)
 }
 
 // CloudFuncPubSubCDOps is an entry point function for Google Cloud Functions
 // which is triggered by a PubSub notification using Cloud Deploy's "clouddeploy-operations" topic
 func CloudFuncPubSubCDOps(ctx context.Context, m gcpclouddeploy.OpsMessage) error {
+	// The instance may be frozen once the function returns, before the spans
+	// are exported in the background.
+	defer func() {
+		if err := tracing.Flush(ctx); err != nil {
+			slog.ErrorContext(ctx, "could not export the spans", "error", err)
+		}
+	}()
 
-	fmt.Printf("{\"message\": \"received: %s | status: %s\", \"severity\":\"info\"}\n", m.Attributes["ResourceType"], m.Attributes["Action"])
+	n, err := notifier()
+	if err != nil {
+		// Failing lets Pub/Sub redeliver the event, or dead-letter it, so it
+		// isn't lost while the function is redeployed with a fixed config.
+		slog.Log(ctx, logging.LevelCritical, "invalid configuration", "error", err)
+		return err
+	}
 
-	resp, err := theBot.SendMessage(channel, m.Attributes)
-	resp = strings.ReplaceAll(resp, "\"", "'")
+	return n.Process(ctx, m)
+}
+
+// Process posts m to the chat app. It only returns an error when posting
+// failed but might succeed if m is delivered again.
+func (n *Notifier) Process(ctx context.Context, m gcpclouddeploy.OpsMessage) (err error) {
+	start := time.Now()
+	resourceType := m.Attributes["ResourceType"]
+	metrics.Received(resourceType)
+
+	ctx, span := tracing.StartReceive(tracing.FromAttributes(ctx, m.Attributes),
+		trace.WithAttributes(
+			attribute.String("messaging.message.id", m.ID),
+			attribute.String("clouddeploy.resource_type", resourceType),
+			attribute.String("clouddeploy.action", m.Attributes["Action"]),
+			attribute.String("clouddeploy.pipeline", m.Attributes["DeliveryPipelineId"]),
+			attribute.String("clouddeploy.release", m.Attributes["ReleaseId"]),
+			attribute.String("clouddeploy.target", m.Attributes["TargetId"]),
+		))
+	defer func() { tracing.End(span, err) }()
+
+	ctx = logging.WithLabels(ctx,
+		"pipeline", m.Attributes["DeliveryPipelineId"],
+		"release", m.Attributes["ReleaseId"],
+		"target", m.Attributes["TargetId"])
+
+	slog.InfoContext(ctx, "received notification", "resourceType", m.Attributes["ResourceType"], "action", m.Attributes["Action"])
+
+	cfg, theBot, stale := n.route(ctx, m)
+	if stale {
+		metrics.Dropped(resourceType, metrics.ReasonStale, start)
+		return nil
+	}
+
+	adapter := cfg.Adapter()
+	metrics.Routed(adapter, resourceType)
+	atts := n.enrich(ctx, m.Attributes)
+	resp, err := metrics.Instrument(adapter, theBot).SendMessageContext(ctx, cfg.Channel, atts)
 	if err != nil {
-		fmt.Printf("{\"message\":\"error posting to Chat App: %s\", \"severity\":\"error\"}\n", err)
-	} else {
-		fmt.Printf("{\"message\": \"success posting to Chat App: %s\", \"severity\": \"info\"}\n", resp)
+		slog.ErrorContext(ctx, "error posting to Chat App", "error", err, "retryable", bot.IsRetryable(err))
+
+		// Returning an error makes Pub/Sub redeliver the event, provided
+		// "Retry on failure" is enabled on the function. Only do so when
+		// there is a chance the next attempt will succeed.
+		if bot.IsRetryable(err) {
+			metrics.Retried(adapter, resourceType, start)
+			return err
+		}
+		metrics.Dropped(resourceType, metrics.ReasonPermanent, start)
+		span.RecordError(err)
+		return nil
 	}
 
+	slog.InfoContext(ctx, "success posting to Chat App", "response", resp)
+	metrics.Delivered(adapter, resourceType, start)
+
 	// no need to ack as per comment box at
 	// https://cloud.google.com/functions/docs/calling/pubsub#sample_code
 	return nil
 }
+
+// route picks the config and bot for m, and tells whether m is too old to post.
+func (n *Notifier) route(ctx context.Context, m gcpclouddeploy.OpsMessage) (*config.Config, bot.Bot, bool) {
+	ctx, span := tracing.Start(ctx, "deploybot.route")
+	defer span.End()
+
+	cfg, theBot := n.current(ctx)
+	span.SetAttributes(attribute.String("deploybot.adapter", cfg.Adapter()))
+
+	maxEventAge := time.Duration(cfg.MaxEventAge)
+	if age := time.Since(eventTime(ctx, m)); maxEventAge > 0 && age > maxEventAge {
+		slog.WarnContext(ctx, "dropping stale event", "age", age.Round(time.Second).String())
+		span.SetAttributes(attribute.Bool("deploybot.stale", true))
+		return cfg, theBot, true
+	}
+	return cfg, theBot, false
+}
+
+// enrich adds the details of the release to atts when enabled. Without them
+// the notification is still posted, e.g. when the API can't be reached.
+func (n *Notifier) enrich(ctx context.Context, atts map[string]string) map[string]string {
+	if n.enricher == nil {
+		return atts
+	}
+
+	ctx, span := tracing.Start(ctx, "deploybot.enrich")
+	ctx, cancel := context.WithTimeout(ctx, enrichTimeout)
+	defer cancel()
+
+	enriched, err := n.enricher.Enrich(ctx, atts)
+	tracing.End(span, err)
+	if err != nil {
+		slog.WarnContext(ctx, "could not enrich notification, posting it as is", "error", err)
+	}
+	return enriched
+}
+
+// CloudEventPubSubCDOps is an entry point function for 2nd gen Google Cloud
+// Functions and Eventarc, which deliver the "clouddeploy-operations" messages
+// as CloudEvents. It processes them just like CloudFuncPubSubCDOps.
+func CloudEventPubSubCDOps(ctx context.Context, e event.Event) error {
+	start := time.Now()
+	m, err := gcpclouddeploy.FromCloudEvent(e)
+	ctx = tracing.Parsed(ctx, start, err)
+	if err != nil {
+		_, span := tracing.StartReceive(ctx, trace.WithAttributes(attribute.String("messaging.message.id", e.ID())))
+		tracing.End(span, err)
+		if err := tracing.Flush(ctx); err != nil {
+			slog.ErrorContext(ctx, "could not export the spans", "error", err)
+		}
+
+		// The event will never decode, so don't ask for it to be redelivered.
+		slog.ErrorContext(ctx, "dropping event which could not be decoded", "id", e.ID(), "error", err)
+		metrics.Dropped("", metrics.ReasonInvalid, start)
+		return nil
+	}
+
+	return CloudFuncPubSubCDOps(ctx, m)
+}
+
+// eventTime returns when the event was published, preferring the timestamp
+// Cloud Functions puts in the context over the one in the message.
+func eventTime(ctx context.Context, m gcpclouddeploy.OpsMessage) time.Time {
+	if meta, err := metadata.FromContext(ctx); err == nil && !meta.Timestamp.IsZero() {
+		return meta.Timestamp
+	}
+	if !m.PublishTime.IsZero() {
+		return m.PublishTime
+	}
+	return time.Now()
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deploybot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/config"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy/fake"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/secrets"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeBot records the messages it is asked to send and fails with err.
+type fakeBot struct {
+	sent []map[string]string
+	err  error
+}
+
+func (f *fakeBot) SendMessage(channel string, message map[string]string) (string, error) {
+	f.sent = append(f.sent, message)
+	return "sent", f.err
+}
+
+func TestProcess(t *testing.T) {
+	fresh := time.Now()
+	stale := time.Now().Add(-2 * time.Hour)
+
+	tests := []struct {
+		name        string
+		publishTime time.Time
+		err         error
+		sent        int
+		wantErr     bool
+	}{
+		{"posted", fresh, nil, 1, false},
+		{"retryable", fresh, &bot.DeliveryError{StatusCode: 503, Retryable: true, Err: errors.New("down")}, 1, true},
+		{"permanent", fresh, bot.ErrUnsupportedResource, 1, false},
+		{"stale", stale, nil, 0, false},
+	}
+
+	for _, test := range tests {
+		fake := &fakeBot{err: test.err}
+		n := &Notifier{cfg: &config.Config{Channel: "C123", MaxEventAge: config.Duration(time.Hour)}, bot: fake}
+
+		m := gcpclouddeploy.OpsMessage{
+			Attributes:  map[string]string{"ResourceType": "Rollout", "Action": "Succeed"},
+			PublishTime: test.publishTime,
+		}
+		err := n.Process(context.Background(), m)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error %v, got: %v", test.name, test.wantErr, err)
+		}
+		if len(fake.sent) != test.sent {
+			t.Errorf("%s: wanted %d messages sent, got: %d", test.name, test.sent, len(fake.sent))
+		}
+	}
+}
+
+func TestProcessEnriched(t *testing.T) {
+	server := fake.NewServer()
+	defer server.Close()
+	server.AddSamplePipeline("projects/1234/locations/us-central1")
+
+	var testTable = []struct {
+		name       string
+		release    string
+		wantImages string
+	}{
+		{"enriched", "rel-2", "us-docker.pkg.dev/my-project/apps/web:1f2e3d4"},
+		{"unknown release", "rel-9", ""},
+	}
+
+	for _, test := range testTable {
+		theBot := &fakeBot{}
+		n := &Notifier{
+			cfg:      &config.Config{Channel: "C123"},
+			bot:      theBot,
+			enricher: &gcpclouddeploy.Enricher{Client: &gcpclouddeploy.Client{Options: server.Options()}},
+		}
+
+		m := gcpclouddeploy.OpsMessage{
+			Attributes:  map[string]string{"ResourceType": "Release", "Action": "Succeed", "ProjectNumber": "1234", "Location": "us-central1", "DeliveryPipelineId": "web-app", "ReleaseId": test.release},
+			PublishTime: time.Now(),
+		}
+		if err := n.Process(context.Background(), m); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if len(theBot.sent) != 1 {
+			t.Fatalf("%s: wanted the message to be sent, got: %d", test.name, len(theBot.sent))
+		}
+		if got := theBot.sent[0]; got["Images"] != test.wantImages || got["ReleaseId"] != test.release {
+			t.Errorf("%s: wanted images %q, got: %v", test.name, test.wantImages, got)
+		}
+	}
+}
+
+func TestNewNotifierValidates(t *testing.T) {
+	if _, err := NewNotifier(&config.Config{ChatApp: "teams"}); err == nil {
+		t.Errorf("wanted an error for an unknown chat app")
+	}
+
+	// Several configs can live side by side in one process.
+	slack, err := NewNotifier(&config.Config{Token: "xoxb-1", Channel: "C123"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chat, err := NewNotifier(&config.Config{ChatApp: "google-webhook", Token: "https://chat.googleapis.com/v1/spaces/A/messages"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := slack.bot.(*bot.SlackAdapter); !ok {
+		t.Errorf("wanted a SlackAdapter, got: %T", slack.bot)
+	}
+	if _, ok := chat.bot.(*bot.GChatWebhookAdapter); !ok {
+		t.Errorf("wanted a GChatWebhookAdapter, got: %T", chat.bot)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	const ref = "sm://projects/myproject/secrets/slack-token/versions/latest"
+	src := &secrets.Memory{}
+	src.Set(ref, "xoxb-1")
+
+	cfg := &config.Config{Token: ref, Channel: "C123", TokenRefresh: config.Duration(time.Nanosecond)}
+	if err := cfg.Resolve(context.Background(), src); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n, err := NewNotifier(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	src.Set(ref, "xoxb-2")
+	time.Sleep(time.Millisecond)
+
+	_, theBot := n.current(context.Background())
+	if token := theBot.(*bot.SlackAdapter).BotToken; token != "xoxb-2" {
+		t.Errorf("wanted the rotated token, got: %s", token)
+	}
+
+	// A secret that can't be read keeps the last good token.
+	n.cfg.TokenSecret = "sm://projects/myproject/secrets/gone/versions/latest"
+	time.Sleep(time.Millisecond)
+	_, theBot = n.current(context.Background())
+	if token := theBot.(*bot.SlackAdapter).BotToken; token != "xoxb-2" {
+		t.Errorf("wanted the last good token kept, got: %s", token)
+	}
+}
+
+func TestProcessSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true, "channel": "C123", "ts": "1.2"}`))
+	}))
+	defer slack.Close()
+
+	n := &Notifier{
+		cfg: &config.Config{Channel: "C123"},
+		bot: &bot.SlackAdapter{BotToken: "xoxb-1", URLEndpoint: slack.URL},
+	}
+	m := gcpclouddeploy.OpsMessage{Attributes: map[string]string{
+		"ResourceType":          "Rollout",
+		"Action":                "Succeed",
+		tracing.PubSubAttribute: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"DeliveryPipelineId":    "web-app",
+		"ReleaseId":             "rel-1",
+		"TargetId":              "prod",
+	}}
+	// As parsed by CloudEventPubSubCDOps or the push handler.
+	ctx := tracing.Parsed(context.Background(), time.Now(), nil)
+	if err := n.Process(ctx, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parents := make(map[string]string)
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("%s: wanted the publisher's trace, got: %s", span.Name, span.SpanContext.TraceID())
+		}
+		parents[span.Name] = span.Parent.SpanID().String()
+	}
+
+	receive := ""
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "deploybot.receive" {
+			receive = span.SpanContext.SpanID().String()
+		}
+	}
+	want := map[string]string{
+		"deploybot.receive":      "b7ad6b7169203331",
+		"deploybot.parse":        receive,
+		"deploybot.route":        receive,
+		"deploybot.render":       receive,
+		"slack chat.postMessage": receive,
+	}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("wanted spans %v, got: %v", want, parents)
+	}
+}
+
+func TestCloudEventSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	e := event.New()
+	e.SetID("2070443601311540")
+	e.SetData("application/json", []byte("not json"))
+	if err := CloudEventPubSubCDOps(context.Background(), e); err != nil {
+		t.Fatalf("wanted the event dropped, got: %v", err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	receive, parse := spans["deploybot.receive"], spans["deploybot.parse"]
+	if len(spans) != 2 || parse.Parent.SpanID() != receive.SpanContext.SpanID() {
+		t.Fatalf("wanted deploybot.parse under deploybot.receive, got: %v", spans)
+	}
+	if parse.Status.Code != codes.Error || receive.Status.Code != codes.Error {
+		t.Errorf("wanted both spans failed, got: %v, %v", parse.Status, receive.Status)
+	}
+}
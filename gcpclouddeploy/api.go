@@ -0,0 +1,439 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpclouddeploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/clouddeploy/v1"
+	"google.golang.org/api/option"
+)
+
+// maxReleases bounds how far back Status and PreviousRelease look for what is
+// deployed.
+const maxReleases = 20
+
+// Client queries the Cloud Deploy API about the pipelines in Project and
+// Location.
+type Client struct {
+	Project  string
+	Location string
+	// Options are handed to the API client, e.g. to use another endpoint.
+	Options []option.ClientOption
+
+	mu      sync.Mutex
+	service *clouddeploy.Service
+}
+
+// TargetStatus is what a target of a pipeline runs.
+type TargetStatus struct {
+	TargetID        string
+	RequireApproval bool
+	// Release and Rollout are empty when nothing was deployed recently.
+	Release    string
+	Rollout    string
+	DeployTime string
+}
+
+func (c *Client) api(ctx context.Context) (*clouddeploy.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.service != nil {
+		return c.service, nil
+	}
+	// The service outlives the request which first needs it.
+	service, err := clouddeploy.NewService(context.WithoutCancel(ctx), c.Options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Deploy client: %v", err)
+	}
+	c.service = service
+	return service, nil
+}
+
+// PipelineName is the resource name of the pipeline with id.
+func (c *Client) PipelineName(id string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s", c.Project, c.Location, id)
+}
+
+// Pipeline reads the pipeline with id.
+func (c *Client) Pipeline(ctx context.Context, id string) (*clouddeploy.DeliveryPipeline, error) {
+	return c.pipeline(ctx, c.PipelineName(id))
+}
+
+func (c *Client) pipeline(ctx context.Context, name string) (*clouddeploy.DeliveryPipeline, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.Projects.Locations.DeliveryPipelines.Get(name).Context(ctx).Do()
+}
+
+// Stages lists the stages of the pipeline with id, in order.
+func (c *Client) Stages(ctx context.Context, id string) ([]*clouddeploy.Stage, error) {
+	return c.stages(ctx, c.PipelineName(id))
+}
+
+func (c *Client) stages(ctx context.Context, name string) ([]*clouddeploy.Stage, error) {
+	pipeline, err := c.pipeline(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if pipeline.SerialPipeline == nil {
+		return nil, errors.New("only serial pipelines are supported")
+	}
+	return pipeline.SerialPipeline.Stages, nil
+}
+
+// Target reads the target with id.
+func (c *Client) Target(ctx context.Context, id string) (*clouddeploy.Target, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/targets/%s", c.Project, c.Location, id)
+	return api.Projects.Locations.Targets.Get(name).Context(ctx).Do()
+}
+
+// Releases lists up to n releases of the pipeline with id, newest first.
+func (c *Client) Releases(ctx context.Context, id string, n int) ([]*clouddeploy.Release, error) {
+	return c.releases(ctx, c.PipelineName(id), n)
+}
+
+func (c *Client) releases(ctx context.Context, pipeline string, n int) ([]*clouddeploy.Release, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []*clouddeploy.Release
+	call := api.Projects.Locations.DeliveryPipelines.Releases.List(pipeline).OrderBy("create_time desc").PageSize(int64(n))
+	err = call.Pages(ctx, func(page *clouddeploy.ListReleasesResponse) error {
+		releases = append(releases, page.Releases...)
+		if len(releases) >= n {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+
+	sort.SliceStable(releases, func(i, j int) bool { return releases[i].CreateTime > releases[j].CreateTime })
+	if len(releases) > n {
+		releases = releases[:n]
+	}
+	return releases, nil
+}
+
+// Release gets the release with the resource name name.
+func (c *Client) Release(ctx context.Context, name string) (*clouddeploy.Release, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.Projects.Locations.DeliveryPipelines.Releases.Get(name).Context(ctx).Do()
+}
+
+// Rollouts lists the rollouts of the release with the resource name release,
+// newest first.
+func (c *Client) Rollouts(ctx context.Context, release string) ([]*clouddeploy.Rollout, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rollouts []*clouddeploy.Rollout
+	err = api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.List(release).Pages(ctx, func(page *clouddeploy.ListRolloutsResponse) error {
+		rollouts = append(rollouts, page.Rollouts...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(rollouts, func(i, j int) bool { return rollouts[i].CreateTime > rollouts[j].CreateTime })
+	return rollouts, nil
+}
+
+// Rollout gets the rollout with the resource name name.
+func (c *Client) Rollout(ctx context.Context, name string) (*clouddeploy.Rollout, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Get(name).Context(ctx).Do()
+}
+
+// Status tells which release each target of the pipeline with id runs, going
+// through the recent releases for the latest successful rollout per target.
+// A rollback rolls an older release out again, so the rollouts are compared
+// by when they ended rather than by release. The targets, and the rollouts of
+// the releases, are read concurrently.
+func (c *Client) Status(ctx context.Context, id string) ([]TargetStatus, error) {
+	stages, err := c.Stages(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]TargetStatus, len(stages))
+	index := make(map[string]int)
+	for i, stage := range stages {
+		status[i] = TargetStatus{TargetID: stage.TargetId}
+		index[stage.TargetId] = i
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(status))
+	for i := range status {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target, err := c.Target(ctx, status[i].TargetID)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			status[i].RequireApproval = target.RequireApproval
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	releases, err := c.Releases(ctx, id, maxReleases)
+	if err != nil {
+		return nil, err
+	}
+	rollouts := make([][]*clouddeploy.Rollout, len(releases))
+	errs = make([]error, len(releases))
+	for i, release := range releases {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rollouts[i], errs[i] = c.Rollouts(ctx, release.Name)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	latest := make([]time.Time, len(status))
+	for r, release := range releases {
+		for _, rollout := range rollouts[r] {
+			i, ok := index[rollout.TargetId]
+			if !ok || rollout.State != "SUCCEEDED" {
+				continue
+			}
+			end, err := time.Parse(time.RFC3339Nano, rollout.DeployEndTime)
+			if err != nil || !end.After(latest[i]) {
+				continue
+			}
+			latest[i] = end
+			status[i].Release = ResourceID(release.Name)
+			status[i].Rollout = ResourceID(rollout.Name)
+			status[i].DeployTime = rollout.DeployEndTime
+		}
+	}
+
+	return status, nil
+}
+
+// NextTarget is the target following from in the pipeline of the release with
+// the resource name release, where gcloud deploy releases promote would go.
+func (c *Client) NextTarget(ctx context.Context, release string, from string) (string, error) {
+	stages, err := c.stages(ctx, path.Dir(path.Dir(release)))
+	if err != nil {
+		return "", err
+	}
+
+	for i, stage := range stages {
+		if stage.TargetId == from && i+1 < len(stages) {
+			return stages[i+1].TargetId, nil
+		}
+	}
+	return "", fmt.Errorf("%s is the last target of the pipeline, or not in it", from)
+}
+
+// PreviousRelease is the newest release older than the one with the resource
+// name release which was successfully rolled out to target, i.e. what to roll
+// target back to.
+func (c *Client) PreviousRelease(ctx context.Context, release string, target string) (string, error) {
+	releases, err := c.releases(ctx, path.Dir(path.Dir(release)), maxReleases)
+	if err != nil {
+		return "", err
+	}
+
+	older := false
+	for _, r := range releases {
+		if ResourceID(r.Name) == ResourceID(release) {
+			older = true
+			continue
+		}
+		if !older {
+			continue
+		}
+
+		rollouts, err := c.Rollouts(ctx, r.Name)
+		if err != nil {
+			return "", err
+		}
+		for _, rollout := range rollouts {
+			if rollout.TargetId == target && rollout.State == "SUCCEEDED" {
+				return r.Name, nil
+			}
+		}
+	}
+
+	if !older {
+		return "", fmt.Errorf("%s is not among the %d latest releases", ResourceID(release), maxReleases)
+	}
+	return "", fmt.Errorf("no release before %s was deployed to %s", ResourceID(release), target)
+}
+
+// CreateRollout deploys the release with the resource name release to target.
+// The rollout is named like gcloud does, e.g. rel-1-to-prod-0002.
+func (c *Client) CreateRollout(ctx context.Context, release string, target string) (string, error) {
+	api, err := c.api(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	rollouts, err := c.Rollouts(ctx, release)
+	if err != nil {
+		return "", err
+	}
+	count := 1
+	for _, rollout := range rollouts {
+		if rollout.TargetId == target {
+			count++
+		}
+	}
+
+	id := rolloutID(ResourceID(release), target, count)
+	_, err = api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Create(release, &clouddeploy.Rollout{TargetId: target}).RolloutId(id).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("could not create rollout: %w", err)
+	}
+	return release + "/rollouts/" + id, nil
+}
+
+// FailedJob finds the phase and job which failed in the rollout with the
+// resource name rollout, i.e. what to retry.
+func (c *Client) FailedJob(ctx context.Context, rollout string) (string, string, error) {
+	r, err := c.Rollout(ctx, rollout)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, phase := range r.Phases {
+		var jobs []*clouddeploy.Job
+		if d := phase.DeploymentJobs; d != nil {
+			jobs = append(jobs, d.PredeployJob, d.DeployJob, d.VerifyJob, d.PostdeployJob)
+		}
+		if c := phase.ChildRolloutJobs; c != nil {
+			jobs = append(jobs, c.CreateRolloutJobs...)
+			jobs = append(jobs, c.AdvanceRolloutJobs...)
+		}
+		for _, job := range jobs {
+			if job != nil && job.State == "FAILED" {
+				return phase.Id, job.Id, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no job failed in rollout %s", ResourceID(rollout))
+}
+
+// RetryJob runs the job of the phase of the rollout with the resource name
+// rollout again.
+func (c *Client) RetryJob(ctx context.Context, rollout string, phase string, job string) error {
+	api, err := c.api(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.RetryJob(rollout, &clouddeploy.RetryJobRequest{PhaseId: phase, JobId: job}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not retry job: %w", err)
+	}
+	return nil
+}
+
+// CancelRollout stops the rollout with the resource name rollout.
+func (c *Client) CancelRollout(ctx context.Context, rollout string) error {
+	api, err := c.api(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Cancel(rollout, &clouddeploy.CancelRolloutRequest{}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not cancel rollout: %w", err)
+	}
+	return nil
+}
+
+// NextPhase is the phase of r following from, which advancing r goes to.
+func NextPhase(r *clouddeploy.Rollout, from string) (string, error) {
+	for i, phase := range r.Phases {
+		if phase.Id == from && i+1 < len(r.Phases) {
+			return r.Phases[i+1].Id, nil
+		}
+	}
+	return "", fmt.Errorf("%s is the last phase of rollout %s, or not in it", from, ResourceID(r.Name))
+}
+
+// AdvanceRollout moves the rollout with the resource name rollout on to
+// phase.
+func (c *Client) AdvanceRollout(ctx context.Context, rollout string, phase string) error {
+	api, err := c.api(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Advance(rollout, &clouddeploy.AdvanceRolloutRequest{PhaseId: phase}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not advance rollout: %w", err)
+	}
+	return nil
+}
+
+// rolloutID keeps within the 63 characters allowed in IDs by shortening the
+// release part.
+func rolloutID(release string, target string, count int) string {
+	suffix := fmt.Sprintf("-to-%s-%04d", target, count)
+	if len(release)+len(suffix) > 63 {
+		release = strings.TrimRight(release[:63-len(suffix)], "-")
+	}
+	return release + suffix
+}
+
+// ResourceID is the last part of a resource name.
+func ResourceID(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// errStop ends a paged listing early.
+var errStop = errors.New("stop listing")
@@ -0,0 +1,228 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpclouddeploy
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy/fake"
+	"google.golang.org/api/clouddeploy/v1"
+)
+
+func testClient(t *testing.T) (*Client, *fake.Server) {
+	server := fake.NewServer()
+	t.Cleanup(server.Close)
+	server.AddSamplePipeline("projects/my-project/locations/us-central1")
+
+	return &Client{Project: "my-project", Location: "us-central1", Options: server.Options()}, server
+}
+
+func TestStatus(t *testing.T) {
+	client, _ := testClient(t)
+
+	status, err := client.Status(context.Background(), "web-app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []TargetStatus{
+		{TargetID: "staging", Release: "rel-2", Rollout: "rel-2-to-staging-0001", DeployTime: "2021-06-02T10:05:00Z"},
+		{TargetID: "prod", RequireApproval: true, Release: "rel-1", Rollout: "rel-1-to-prod-0001", DeployTime: "2021-06-01T11:05:00Z"},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("wanted %+v, got: %+v", want, status)
+	}
+}
+
+func TestStatusAfterRollback(t *testing.T) {
+	client, server := testClient(t)
+	pipeline := "projects/my-project/locations/us-central1/deliveryPipelines/web-app"
+	// rel-2 succeeded on prod, which was then rolled back to rel-1.
+	server.Add(pipeline+"/releases/rel-2/rollouts/rel-2-to-prod-0002", map[string]interface{}{
+		"targetId": "prod", "state": "SUCCEEDED", "createTime": "2021-06-02T12:00:00Z", "deployEndTime": "2021-06-02T12:05:00Z",
+	})
+	server.Add(pipeline+"/releases/rel-1/rollouts/rel-1-to-prod-0002", map[string]interface{}{
+		"targetId": "prod", "state": "SUCCEEDED", "createTime": "2021-06-02T13:00:00Z", "deployEndTime": "2021-06-02T13:05:00.5Z",
+	})
+
+	status, err := client.Status(context.Background(), "web-app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := TargetStatus{TargetID: "prod", RequireApproval: true, Release: "rel-1", Rollout: "rel-1-to-prod-0002", DeployTime: "2021-06-02T13:05:00.5Z"}
+	if status[1] != want {
+		t.Errorf("wanted %+v, got: %+v", want, status[1])
+	}
+}
+
+func TestReleases(t *testing.T) {
+	client, _ := testClient(t)
+
+	var testTable = []struct {
+		n    int
+		want []string
+	}{
+		{1, []string{"rel-2"}},
+		{5, []string{"rel-2", "rel-1"}},
+	}
+
+	for _, test := range testTable {
+		releases, err := client.Releases(context.Background(), "web-app", test.n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var got []string
+		for _, release := range releases {
+			got = append(got, ResourceID(release.Name))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d releases: wanted %v, got: %v", test.n, test.want, got)
+		}
+	}
+}
+
+func TestUnknownPipeline(t *testing.T) {
+	client, _ := testClient(t)
+
+	if _, err := client.Status(context.Background(), "nope"); err == nil {
+		t.Errorf("wanted an error for an unknown pipeline")
+	}
+}
+
+func TestPreviousRelease(t *testing.T) {
+	client, _ := testClient(t)
+	pipeline := "projects/my-project/locations/us-central1/deliveryPipelines/web-app"
+
+	var testTable = []struct {
+		release string
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{"rel-2", "prod", pipeline + "/releases/rel-1", false},
+		{"rel-1", "prod", "", true},
+		{"rel-9", "prod", "", true},
+	}
+
+	for _, test := range testTable {
+		got, err := client.PreviousRelease(context.Background(), pipeline+"/releases/"+test.release, test.target)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s on %s: wanted %q (error %v), got: %q (%v)", test.release, test.target, test.want, test.wantErr, got, err)
+		}
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	client, _ := testClient(t)
+	releases := "projects/my-project/locations/us-central1/deliveryPipelines/web-app/releases/"
+
+	phase, job, err := client.FailedJob(context.Background(), releases+"rel-2/rollouts/rel-2-to-prod-0001")
+	if err != nil || phase != "stable" || job != "verify" {
+		t.Errorf("wanted the verify job of the stable phase, got: %q %q (%v)", phase, job, err)
+	}
+
+	if _, _, err := client.FailedJob(context.Background(), releases+"rel-2/rollouts/rel-2-to-staging-0001"); err == nil {
+		t.Errorf("wanted an error for a successful rollout")
+	}
+}
+
+func TestNextPhase(t *testing.T) {
+	r := &clouddeploy.Rollout{Name: "rel-3-to-prod-0001", Phases: []*clouddeploy.Phase{{Id: "canary-25"}, {Id: "canary-50"}, {Id: "stable"}}}
+
+	var testTable = []struct {
+		from    string
+		want    string
+		wantErr bool
+	}{
+		{"canary-25", "canary-50", false},
+		{"canary-50", "stable", false},
+		{"stable", "", true},
+		{"canary-75", "", true},
+	}
+
+	for _, test := range testTable {
+		got, err := NextPhase(r, test.from)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("from %s: wanted %q (error %v), got: %q (%v)", test.from, test.want, test.wantErr, got, err)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	client, server := testClient(t)
+	enricher := &Enricher{Client: client}
+	server.Add("projects/my-project/locations/us-central1/deliveryPipelines/web-app/releases/rel-2/rollouts/rel-2-to-staging-0002", map[string]interface{}{
+		"targetId": "staging", "state": "IN_PROGRESS", "annotations": map[string]interface{}{"commit-sha": "9a8b7c6d5e4f", "ticket": "OPS-7"},
+	})
+
+	atts := map[string]string{"ResourceType": "Release", "Action": "Succeed", "ProjectNumber": "my-project", "Location": "us-central1", "DeliveryPipelineId": "web-app", "ReleaseId": "rel-2"}
+	rollout := map[string]string{"ResourceType": "Rollout", "Action": "Start", "ProjectNumber": "my-project", "Location": "us-central1", "DeliveryPipelineId": "web-app", "ReleaseId": "rel-2", "RolloutId": "rel-2-to-staging-0002", "TargetId": "staging"}
+
+	var testTable = []struct {
+		name    string
+		atts    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"Release", atts, map[string]string{
+			"Images":          "us-docker.pkg.dev/my-project/apps/web:1f2e3d4",
+			"SkaffoldVersion": "2.3.0",
+			"CreatedBy":       "alice@example.com",
+			"Annotations":     "commit-sha=1f2e3d4c5b6a\npull-request=https://github.com/example/web-app/pull/42",
+		}, false},
+		{"Rollout annotations win", rollout, map[string]string{
+			"Images":          "us-docker.pkg.dev/my-project/apps/web:1f2e3d4",
+			"SkaffoldVersion": "2.3.0",
+			"CreatedBy":       "alice@example.com",
+			"Annotations":     "commit-sha=9a8b7c6d5e4f\npull-request=https://github.com/example/web-app/pull/42\nticket=OPS-7",
+		}, false},
+		{"No details", map[string]string{"ResourceType": "Release", "ProjectNumber": "my-project", "Location": "us-central1", "DeliveryPipelineId": "web-app", "ReleaseId": "rel-1"}, nil, false},
+		{"Unknown release", map[string]string{"ResourceType": "Release", "ProjectNumber": "my-project", "Location": "us-central1", "DeliveryPipelineId": "web-app", "ReleaseId": "rel-9"}, nil, true},
+	}
+
+	for _, test := range testTable {
+		enriched, err := enricher.Enrich(context.Background(), test.atts)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("%s: wanted error %v, got: %v", test.name, test.wantErr, err)
+		}
+		for key, value := range test.atts {
+			if enriched[key] != value {
+				t.Errorf("%s: wanted %s kept as %q, got: %q", test.name, key, value, enriched[key])
+			}
+		}
+		for _, key := range []string{"Images", "SkaffoldVersion", "CreatedBy", "Annotations"} {
+			if enriched[key] != test.want[key] {
+				t.Errorf("%s: wanted %s %q, got: %q", test.name, key, test.want[key], enriched[key])
+			}
+		}
+	}
+	if _, ok := atts["Images"]; ok {
+		t.Errorf("wanted the attributes to be left as they are")
+	}
+
+	// rel-2 was read once, its rollout every time.
+	gets := make(map[string]int)
+	for _, call := range server.Calls() {
+		gets[path.Base(call.Name)]++
+	}
+	if gets["rel-2"] != 1 || gets["rel-2-to-staging-0002"] != 1 {
+		t.Errorf("wanted the release to be cached, got calls: %v", gets)
+	}
+}
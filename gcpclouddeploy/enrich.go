@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpclouddeploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/clouddeploy/v1"
+)
+
+// CreatorAnnotation is the annotation telling who created a release, which
+// Cloud Deploy doesn't record itself. It can be set with e.g.
+// gcloud deploy releases create --annotations=created-by=$(gcloud config get account)
+const CreatorAnnotation = "created-by"
+
+// maxCachedReleases bounds how many releases an Enricher remembers.
+const maxCachedReleases = 100
+
+// Enricher adds what the Cloud Deploy API knows about the release, and
+// rollout, of a notification to its attributes, which only name them:
+//
+//	Images           the release's build artifacts, one per line.
+//	SkaffoldVersion  the Skaffold version of the release.
+//	Annotations      the release's annotations, overridden by the rollout's,
+//	                 as key=value lines sorted by key.
+//	CreatedBy        the CreatorAnnotation.
+//
+// Releases are cached, as most notifications are about the rollouts of a
+// few of them.
+type Enricher struct {
+	Client *Client
+
+	mu       sync.Mutex
+	releases map[string]*clouddeploy.Release
+	// order lists the cached releases, oldest first.
+	order []string
+}
+
+// Enrich returns a copy of atts with the details of the resources they name.
+// atts are returned as they are when they don't name a release.
+func (e *Enricher) Enrich(ctx context.Context, atts map[string]string) (map[string]string, error) {
+	if atts["ReleaseId"] == "" {
+		return atts, nil
+	}
+
+	name := fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/%s", atts["ProjectNumber"], atts["Location"], atts["DeliveryPipelineId"], atts["ReleaseId"])
+	release, err := e.release(ctx, name)
+	if err != nil {
+		return atts, fmt.Errorf("could not get release %s: %v", name, err)
+	}
+
+	annotations := make(map[string]string)
+	for key, value := range release.Annotations {
+		annotations[key] = value
+	}
+	if atts["ResourceType"] == "Rollout" && atts["RolloutId"] != "" {
+		rollout, err := e.Client.Rollout(ctx, name+"/rollouts/"+atts["RolloutId"])
+		if err != nil {
+			return atts, fmt.Errorf("could not get rollout %s: %v", atts["RolloutId"], err)
+		}
+		for key, value := range rollout.Annotations {
+			annotations[key] = value
+		}
+	}
+
+	enriched := make(map[string]string, len(atts)+4)
+	for key, value := range atts {
+		enriched[key] = value
+	}
+
+	var images []string
+	for _, artifact := range release.BuildArtifacts {
+		// Tag is the full image reference, Image only its name in Skaffold.
+		if artifact.Tag != "" {
+			images = append(images, artifact.Tag)
+		} else if artifact.Image != "" {
+			images = append(images, artifact.Image)
+		}
+	}
+	if len(images) > 0 {
+		enriched["Images"] = strings.Join(images, "\n")
+	}
+	if release.SkaffoldVersion != "" {
+		enriched["SkaffoldVersion"] = release.SkaffoldVersion
+	}
+	if creator := annotations[CreatorAnnotation]; creator != "" {
+		enriched["CreatedBy"] = creator
+		delete(annotations, CreatorAnnotation)
+	}
+
+	var lines []string
+	for key, value := range annotations {
+		lines = append(lines, key+"="+strings.ReplaceAll(value, "\n", " "))
+	}
+	if len(lines) > 0 {
+		sort.Strings(lines)
+		enriched["Annotations"] = strings.Join(lines, "\n")
+	}
+	return enriched, nil
+}
+
+// release gets the release with the resource name name, from the cache if
+// it was seen before.
+func (e *Enricher) release(ctx context.Context, name string) (*clouddeploy.Release, error) {
+	e.mu.Lock()
+	release, ok := e.releases[name]
+	e.mu.Unlock()
+	if ok {
+		return release, nil
+	}
+
+	release, err := e.Client.Release(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.releases == nil {
+		e.releases = make(map[string]*clouddeploy.Release)
+	}
+	if _, ok := e.releases[name]; !ok {
+		e.order = append(e.order, name)
+	}
+	e.releases[name] = release
+	if len(e.order) > maxCachedReleases {
+		delete(e.releases, e.order[0])
+		e.order = e.order[1:]
+	}
+	return release, nil
+}
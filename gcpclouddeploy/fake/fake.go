@@ -0,0 +1,238 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake serves an in-memory Cloud Deploy API for tests.
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/option"
+)
+
+// Server answers Get and List calls with the resources added to it, and
+// records every call. Create calls add the resource, other methods such as
+// :cancel only return an empty response.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	resources map[string]map[string]interface{}
+	calls     []Call
+}
+
+// Call is a request made to the Server.
+type Call struct {
+	Method string
+	// Name is the resource name, followed by ":verb" for custom methods.
+	Name  string
+	Query string
+	Body  map[string]interface{}
+}
+
+// NewServer starts a Server. Close it when done.
+func NewServer() *Server {
+	s := &Server{resources: make(map[string]map[string]interface{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Options point a Cloud Deploy client at the Server.
+func (s *Server) Options() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(s.URL + "/"),
+		option.WithHTTPClient(s.Client()),
+	}
+}
+
+// Add stores resource, e.g. a *clouddeploy.Release, under its resource name.
+func (s *Server) Add(name string, resource interface{}) {
+	b, err := json.Marshal(resource)
+	if err != nil {
+		panic(err)
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		panic(err)
+	}
+	m["name"] = name
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources[name] = m
+}
+
+// Calls returns the requests made so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	call := Call{Method: r.Method, Name: name, Query: r.URL.RawQuery}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&call.Body)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+
+	switch {
+	case r.Method == http.MethodPost && strings.Contains(path.Base(name), ":"):
+		resource := strings.SplitN(name, ":", 2)[0]
+		if _, ok := s.resources[resource]; !ok {
+			writeJSON(w, http.StatusNotFound, apiError(http.StatusNotFound, resource+" not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+		return
+	case r.Method == http.MethodPost:
+		s.create(w, r, name, call.Body)
+		return
+	case r.Method != http.MethodGet:
+		writeJSON(w, http.StatusNotImplemented, apiError(http.StatusNotImplemented, "not implemented by the fake"))
+		return
+	}
+
+	if resource, ok := s.resources[name]; ok {
+		writeJSON(w, http.StatusOK, resource)
+		return
+	}
+
+	// List the resources right under name, e.g. the releases of a pipeline.
+	var items []map[string]interface{}
+	for key, resource := range s.resources {
+		if path.Dir(key) == name {
+			items = append(items, resource)
+		}
+	}
+	if len(items) == 0 && !s.exists(path.Dir(name)) {
+		writeJSON(w, http.StatusNotFound, apiError(http.StatusNotFound, name+" not found"))
+		return
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i]["name"].(string) < items[j]["name"].(string) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{path.Base(name): items})
+}
+
+// create adds the resource in body to the collection, under the ID given in
+// the query, e.g. rolloutId, and returns a finished operation.
+func (s *Server) create(w http.ResponseWriter, r *http.Request, collection string, body map[string]interface{}) {
+	if !s.exists(path.Dir(collection)) {
+		writeJSON(w, http.StatusNotFound, apiError(http.StatusNotFound, path.Dir(collection)+" not found"))
+		return
+	}
+
+	id := ""
+	for key, values := range r.URL.Query() {
+		if strings.HasSuffix(key, "Id") && key != "requestId" {
+			id = values[0]
+		}
+	}
+	name := collection + "/" + id
+	if _, ok := s.resources[name]; ok || id == "" {
+		writeJSON(w, http.StatusConflict, apiError(http.StatusConflict, name+" already exists"))
+		return
+	}
+
+	if body == nil {
+		body = make(map[string]interface{})
+	}
+	body["name"] = name
+	s.resources[name] = body
+	location := strings.Join(strings.SplitN(name, "/", 5)[:4], "/")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": location + "/operations/create-" + id, "done": true})
+}
+
+// exists tells whether name, or the location it belongs to, is known.
+func (s *Server) exists(name string) bool {
+	if _, ok := s.resources[name]; ok || strings.Count(name, "/") <= 3 {
+		return true
+	}
+	return false
+}
+
+func apiError(code int, message string) map[string]interface{} {
+	return map[string]interface{}{"error": map[string]interface{}{"code": code, "message": message}}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// AddSamplePipeline adds the "web-app" pipeline to parent, e.g.
+// projects/P/locations/L, promoting from "staging" to "prod" which requires
+// approval. rel-2, built from a pull request by alice, runs on staging and
+// failed to verify on prod, which still runs rel-1.
+func (s *Server) AddSamplePipeline(parent string) {
+	pipeline := parent + "/deliveryPipelines/web-app"
+	s.Add(pipeline, map[string]interface{}{
+		"serialPipeline": map[string]interface{}{
+			"stages": []map[string]interface{}{
+				{"targetId": "staging"},
+				{"targetId": "prod"},
+			},
+		},
+	})
+	s.Add(parent+"/targets/staging", map[string]interface{}{"description": "Staging cluster"})
+	s.Add(parent+"/targets/prod", map[string]interface{}{"description": "Production cluster", "requireApproval": true})
+
+	s.Add(pipeline+"/releases/rel-1", map[string]interface{}{"createTime": "2021-06-01T10:00:00Z", "renderState": "SUCCEEDED"})
+	s.Add(pipeline+"/releases/rel-1/rollouts/rel-1-to-staging-0001", map[string]interface{}{
+		"targetId": "staging", "state": "SUCCEEDED", "createTime": "2021-06-01T10:01:00Z", "deployEndTime": "2021-06-01T10:05:00Z",
+	})
+	s.Add(pipeline+"/releases/rel-1/rollouts/rel-1-to-prod-0001", map[string]interface{}{
+		"targetId": "prod", "state": "SUCCEEDED", "createTime": "2021-06-01T11:00:00Z", "deployEndTime": "2021-06-01T11:05:00Z",
+	})
+
+	s.Add(pipeline+"/releases/rel-2", map[string]interface{}{
+		"createTime": "2021-06-02T10:00:00Z", "renderState": "SUCCEEDED", "skaffoldVersion": "2.3.0",
+		"buildArtifacts": []map[string]interface{}{
+			{"image": "web", "tag": "us-docker.pkg.dev/my-project/apps/web:1f2e3d4"},
+		},
+		"annotations": map[string]interface{}{
+			"commit-sha":   "1f2e3d4c5b6a",
+			"pull-request": "https://github.com/example/web-app/pull/42",
+			"created-by":   "alice@example.com",
+		},
+	})
+	s.Add(pipeline+"/releases/rel-2/rollouts/rel-2-to-staging-0001", map[string]interface{}{
+		"targetId": "staging", "state": "SUCCEEDED", "createTime": "2021-06-02T10:01:00Z", "deployEndTime": "2021-06-02T10:05:00Z",
+	})
+	s.Add(pipeline+"/releases/rel-2/rollouts/rel-2-to-prod-0001", map[string]interface{}{
+		"targetId": "prod", "state": "FAILED", "createTime": "2021-06-02T11:00:00Z",
+		"phases": []map[string]interface{}{
+			{
+				"id": "stable", "state": "FAILED",
+				"deploymentJobs": map[string]interface{}{
+					"deployJob": map[string]interface{}{"id": "deploy", "state": "SUCCEEDED"},
+					"verifyJob": map[string]interface{}{"id": "verify", "state": "FAILED"},
+				},
+			},
+		},
+	})
+}
@@ -16,7 +16,12 @@ limitations under the License.
 
 package gcpclouddeploy
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
 
 // OpsMessage was lifted from
 // https://pkg.go.dev/cloud.google.com/go/internal/pubsub#Message
@@ -26,3 +31,45 @@ type OpsMessage struct {
 	Attributes  map[string]string `json:"attributes,omitempty"`
 	PublishTime time.Time         `json:"PublishTime,omitempty"`
 }
+
+// PushRequest is the envelope Pub/Sub push subscriptions POST to their
+// endpoint, see https://cloud.google.com/pubsub/docs/push#receive_push
+type PushRequest struct {
+	Message struct {
+		ID          string            `json:"messageId,omitempty"`
+		Data        []byte            `json:"data,omitempty"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+		PublishTime time.Time         `json:"publishTime,omitempty"`
+	} `json:"message"`
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// OpsMessage returns the message carried by the push request.
+func (p *PushRequest) OpsMessage() OpsMessage {
+	return OpsMessage{
+		ID:          p.Message.ID,
+		Data:        p.Message.Data,
+		Attributes:  p.Message.Attributes,
+		PublishTime: p.Message.PublishTime,
+	}
+}
+
+// MessagePublishedData is the payload of the CloudEvents Eventarc and 2nd gen
+// Cloud Functions deliver for Pub/Sub messages. It has the same shape as a push
+// request, see https://github.com/googleapis/google-cloudevents/blob/main/proto/google/events/cloud/pubsub/v1/data.proto
+type MessagePublishedData = PushRequest
+
+// FromCloudEvent unwraps the Pub/Sub message carried by a
+// google.cloud.pubsub.topic.v1.messagePublished CloudEvent.
+func FromCloudEvent(e event.Event) (OpsMessage, error) {
+	data := &MessagePublishedData{}
+	if err := e.DataAs(data); err != nil {
+		return OpsMessage{}, fmt.Errorf("could not decode MessagePublishedData: %v", err)
+	}
+
+	m := data.OpsMessage()
+	if m.PublishTime.IsZero() {
+		m.PublishTime = e.Time()
+	}
+	return m, nil
+}
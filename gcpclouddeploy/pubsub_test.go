@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcpclouddeploy
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+func TestFromCloudEvent(t *testing.T) {
+	b, err := os.ReadFile("testdata/message_published.json")
+	if err != nil {
+		t.Fatalf("could not read sample event: %v", err)
+	}
+
+	e := event.New()
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatalf("could not decode sample event: %v", err)
+	}
+
+	m, err := FromCloudEvent(e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if m.ID != "2070443601311540" {
+		t.Errorf("wanted the message ID, got: %s", m.ID)
+	}
+	if m.Attributes["ResourceType"] != "Rollout" || m.Attributes["TargetId"] != "prod" {
+		t.Errorf("wanted the attributes, got: %v", m.Attributes)
+	}
+	if string(m.Data) != `{"message":"Rollout succeeded"}` {
+		t.Errorf("wanted the base64 data decoded, got: %s", m.Data)
+	}
+	if want := time.Date(2021, 2, 26, 19, 13, 55, 749000000, time.UTC); !m.PublishTime.Equal(want) {
+		t.Errorf("wanted publish time %v, got: %v", want, m.PublishTime)
+	}
+}
+
+func TestFromCloudEventBadData(t *testing.T) {
+	e := event.New()
+	e.SetType("google.cloud.pubsub.topic.v1.messagePublished")
+	if err := e.SetData(event.TextPlain, "not a message"); err != nil {
+		t.Fatalf("could not set data: %v", err)
+	}
+
+	if _, err := FromCloudEvent(e); err == nil {
+		t.Errorf("wanted an error for data that isn't MessagePublishedData")
+	}
+}
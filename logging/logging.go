@@ -0,0 +1,198 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging writes log/slog records as the structured JSON Cloud Logging
+// understands, see https://cloud.google.com/logging/docs/structured-logging
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LevelCritical is for problems that stop the bot from working at all.
+const LevelCritical = slog.Level(12)
+
+// Special fields Cloud Logging lifts out of the JSON payload.
+const (
+	traceField   = "logging.googleapis.com/trace"
+	spanField    = "logging.googleapis.com/spanId"
+	sampledField = "logging.googleapis.com/trace_sampled"
+	labelsField  = "logging.googleapis.com/labels"
+)
+
+// Setup makes the default slog logger write Cloud Logging JSON to stdout.
+func Setup() {
+	slog.SetDefault(slog.New(NewHandler(os.Stdout, slog.LevelInfo)))
+}
+
+// Fatalf logs a critical message and exits, like log.Fatalf.
+func Fatalf(format string, args ...interface{}) {
+	slog.Log(context.Background(), LevelCritical, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// NewHandler returns a handler writing Cloud Logging JSON to w. Trace and
+// labels added to the context with WithTrace and WithLabels are included.
+func NewHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return &handler{Handler: slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: replaceAttr,
+	})}
+}
+
+type handler struct {
+	slog.Handler
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	t, ok := ctx.Value(traceKey{}).(traceInfo)
+	// Prefer the OpenTelemetry span, whose trace is the one exported.
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		t, ok = traceInfo{traceID: sc.TraceID().String(), spanID: sc.SpanID().String(), sampled: sc.IsSampled()}, true
+	}
+	if ok {
+		if project := projectID(); project != "" {
+			r.AddAttrs(slog.String(traceField, fmt.Sprintf("projects/%s/traces/%s", project, t.traceID)))
+		}
+		if t.spanID != "" {
+			r.AddAttrs(slog.String(spanField, t.spanID))
+		}
+		r.AddAttrs(slog.Bool(sampledField, t.sampled))
+	}
+	if labels, ok := ctx.Value(labelsKey{}).(map[string]string); ok {
+		r.AddAttrs(slog.Any(labelsField, labels))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name)}
+}
+
+// replaceAttr renames slog's level and message to Cloud Logging's severity
+// and message.
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+
+	switch a.Key {
+	case slog.LevelKey:
+		return slog.String("severity", severity(a.Value.Any().(slog.Level)))
+	case slog.MessageKey:
+		return slog.String("message", a.Value.String())
+	}
+	return a
+}
+
+func severity(level slog.Level) string {
+	switch {
+	case level >= LevelCritical:
+		return "CRITICAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+type traceKey struct{}
+
+type traceInfo struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+// WithTrace returns a context whose log entries are correlated with a trace.
+func WithTrace(ctx context.Context, traceID string, spanID string, sampled bool) context.Context {
+	if traceID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, traceInfo{traceID: traceID, spanID: spanID, sampled: sampled})
+}
+
+// TraceFromRequest reads the trace of r from its traceparent or
+// X-Cloud-Trace-Context header.
+func TraceFromRequest(r *http.Request) (traceID string, spanID string, sampled bool) {
+	// traceparent: 00-TRACE_ID-SPAN_ID-FLAGS
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 {
+		return parts[1], parts[2], parts[3] == "01"
+	}
+
+	// X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=OPTIONS
+	header := r.Header.Get("X-Cloud-Trace-Context")
+	if header == "" {
+		return "", "", false
+	}
+	traceID, rest, _ := strings.Cut(header, "/")
+	spanID, options, _ := strings.Cut(rest, ";")
+	return traceID, spanID, options == "o=1"
+}
+
+type labelsKey struct{}
+
+// WithLabels returns a context whose log entries carry the given key value
+// pairs as Cloud Logging labels, on top of those already in ctx. Empty values
+// are left out.
+func WithLabels(ctx context.Context, keyValues ...string) context.Context {
+	labels := make(map[string]string)
+	if existing, ok := ctx.Value(labelsKey{}).(map[string]string); ok {
+		for k, v := range existing {
+			labels[k] = v
+		}
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i+1] != "" {
+			labels[keyValues[i]] = keyValues[i+1]
+		}
+	}
+	return context.WithValue(ctx, labelsKey{}, labels)
+}
+
+var (
+	projectOnce sync.Once
+	project     string
+)
+
+// projectID is needed to format trace names. It comes from the environment,
+// or from the metadata server when running on Google Cloud.
+func projectID() string {
+	projectOnce.Do(func() {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+		if project == "" && metadata.OnGCE() {
+			project, _ = metadata.ProjectIDWithContext(context.Background())
+		}
+	})
+	return project
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep projectID away from the metadata server.
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "my-project")
+	os.Exit(m.Run())
+}
+
+func TestEntries(t *testing.T) {
+	traced := WithTrace(context.Background(), "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", true)
+	labelled := WithLabels(context.Background(), "pipeline", "web-app", "release", "rel-1", "target", "")
+
+	var testTable = []struct {
+		name  string
+		ctx   context.Context
+		level slog.Level
+		want  map[string]interface{}
+	}{
+		{"Info", context.Background(), slog.LevelInfo, map[string]interface{}{
+			"severity": "INFO",
+			"message":  "hello",
+		}},
+		{"Warning", context.Background(), slog.LevelWarn, map[string]interface{}{
+			"severity": "WARNING",
+			"message":  "hello",
+		}},
+		{"Critical", context.Background(), LevelCritical, map[string]interface{}{
+			"severity": "CRITICAL",
+			"message":  "hello",
+		}},
+		{"Trace", traced, slog.LevelError, map[string]interface{}{
+			"severity":                             "ERROR",
+			"message":                              "hello",
+			"logging.googleapis.com/trace":         "projects/my-project/traces/0af7651916cd43dd8448eb211c80319c",
+			"logging.googleapis.com/spanId":        "b7ad6b7169203331",
+			"logging.googleapis.com/trace_sampled": true,
+		}},
+		{"Labels", WithLabels(labelled, "target", "prod"), slog.LevelInfo, map[string]interface{}{
+			"severity": "INFO",
+			"message":  "hello",
+			"logging.googleapis.com/labels": map[string]interface{}{
+				"pipeline": "web-app",
+				"release":  "rel-1",
+				"target":   "prod",
+			},
+		}},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(NewHandler(&buf, slog.LevelDebug))
+			logger.Log(test.ctx, test.level, "hello")
+
+			got := make(map[string]interface{})
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("entry is not JSON: %v\n%s", err, buf.String())
+			}
+			delete(got, "time")
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("entry was %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTraceFromRequest(t *testing.T) {
+	var testTable = []struct {
+		name    string
+		header  string
+		value   string
+		trace   string
+		span    string
+		sampled bool
+	}{
+		{"traceparent", "traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", true},
+		{"Cloud Trace", "X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1", "105445aa7843bc8bf206b12000100000", "1", true},
+		{"Not sampled", "X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=0", "105445aa7843bc8bf206b12000100000", "1", false},
+		{"None", "", "", "", "", false},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			if test.header != "" {
+				r.Header.Set(test.header, test.value)
+			}
+
+			trace, span, sampled := TraceFromRequest(r)
+			if trace != test.trace || span != test.span || sampled != test.sampled {
+				t.Errorf("got %q %q %v, wanted %q %q %v", trace, span, sampled, test.trace, test.span, test.sampled)
+			}
+		})
+	}
+}
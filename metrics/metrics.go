@@ -0,0 +1,173 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics counts the notifications going through the bot and exposes
+// them to Prometheus. Labels only take values from small fixed sets, never
+// pipeline, release or rollout IDs, so the number of series stays bounded.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons a notification is dropped.
+const (
+	ReasonStale     = "stale"
+	ReasonPermanent = "permanent_error"
+	ReasonInvalid   = "invalid"
+)
+
+// Registry holds the bot's metrics, plus the Go runtime and process ones.
+var Registry = prometheus.NewRegistry()
+
+var (
+	received = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploybot_notifications_received_total",
+		Help: "Notifications received, by resource type.",
+	}, []string{"resource_type"})
+
+	routed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploybot_notifications_routed_total",
+		Help: "Notifications handed to a chat app adapter.",
+	}, []string{"adapter", "resource_type"})
+
+	delivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploybot_notifications_delivered_total",
+		Help: "Notifications posted to the chat app.",
+	}, []string{"adapter", "resource_type"})
+
+	retried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploybot_notifications_retried_total",
+		Help: "Notifications which failed and were left for Pub/Sub to redeliver.",
+	}, []string{"adapter", "resource_type"})
+
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deploybot_notifications_dropped_total",
+		Help: "Notifications given up on, by reason.",
+	}, []string{"resource_type", "reason"})
+
+	processDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploybot_process_duration_seconds",
+		Help:    "Time taken to handle a notification, from receipt to outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"resource_type", "outcome"})
+
+	sendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deploybot_send_duration_seconds",
+		Help:    "Time taken by the chat app adapter to post a message.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"adapter", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		received, routed, delivered, retried, dropped, processDuration, sendDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format, e.g. on /metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Cloud Deploy's resource types. Anything else is counted as "other".
+var resourceTypes = map[string]bool{
+	"Automation":       true,
+	"AutomationRun":    true,
+	"CustomTargetType": true,
+	"DeliveryPipeline": true,
+	"DeployPolicy":     true,
+	"JobRun":           true,
+	"Release":          true,
+	"Rollout":          true,
+	"Target":           true,
+}
+
+// ResourceType bounds the resource_type label to the known resource types.
+func ResourceType(resourceType string) string {
+	if resourceTypes[resourceType] {
+		return resourceType
+	}
+	return "other"
+}
+
+// Received counts a notification arriving at the front door.
+func Received(resourceType string) {
+	received.WithLabelValues(ResourceType(resourceType)).Inc()
+}
+
+// Routed counts a notification handed to adapter.
+func Routed(adapter string, resourceType string) {
+	routed.WithLabelValues(adapter, ResourceType(resourceType)).Inc()
+}
+
+// Delivered counts a notification posted by adapter and how long it took to
+// handle since start.
+func Delivered(adapter string, resourceType string, start time.Time) {
+	delivered.WithLabelValues(adapter, ResourceType(resourceType)).Inc()
+	processDuration.WithLabelValues(ResourceType(resourceType), "delivered").Observe(time.Since(start).Seconds())
+}
+
+// Retried counts a notification which will be redelivered.
+func Retried(adapter string, resourceType string, start time.Time) {
+	retried.WithLabelValues(adapter, ResourceType(resourceType)).Inc()
+	processDuration.WithLabelValues(ResourceType(resourceType), "retried").Observe(time.Since(start).Seconds())
+}
+
+// Dropped counts a notification given up on for reason.
+func Dropped(resourceType string, reason string, start time.Time) {
+	dropped.WithLabelValues(ResourceType(resourceType), reason).Inc()
+	processDuration.WithLabelValues(ResourceType(resourceType), "dropped").Observe(time.Since(start).Seconds())
+}
+
+// Instrument wraps b so the latency and outcome of each message sent is
+// recorded under adapter, which should be the name b was registered as.
+func Instrument(adapter string, b bot.Bot) bot.ContextBot {
+	return &instrumented{adapter: adapter, bot: b}
+}
+
+type instrumented struct {
+	adapter string
+	bot     bot.Bot
+}
+
+func (i *instrumented) SendMessage(channel string, message map[string]string) (string, error) {
+	return i.SendMessageContext(context.Background(), channel, message)
+}
+
+func (i *instrumented) SendMessageContext(ctx context.Context, channel string, message map[string]string) (string, error) {
+	start := time.Now()
+	resp, err := bot.Send(ctx, i.bot, channel, message)
+
+	outcome := "ok"
+	if err != nil && bot.IsRetryable(err) {
+		outcome = "retryable_error"
+	} else if err != nil {
+		outcome = "permanent_error"
+	}
+	sendDuration.WithLabelValues(i.adapter, outcome).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
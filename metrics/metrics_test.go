@@ -0,0 +1,143 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type fakeBot struct{ err error }
+
+func (f *fakeBot) SendMessage(channel string, message map[string]string) (string, error) {
+	return "sent", f.err
+}
+
+func TestInstrument(t *testing.T) {
+	var testTable = []struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"ok", nil, "ok"},
+		{"retryable", &bot.DeliveryError{StatusCode: 503, Retryable: true, Err: errors.New("down")}, "retryable_error"},
+		{"permanent", bot.ErrUnsupportedResource, "permanent_error"},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			// The collectors are global, so only the change is checked.
+			before := sampleCount(t, "test-"+test.name, test.outcome)
+			b := Instrument("test-"+test.name, &fakeBot{err: test.err})
+
+			resp, err := b.SendMessageContext(context.Background(), "C123", map[string]string{})
+			if resp != "sent" || err != test.err {
+				t.Errorf("wanted the wrapped bot's results, got: %q %v", resp, err)
+			}
+
+			if n := sampleCount(t, "test-"+test.name, test.outcome); n != before+1 {
+				t.Errorf("wanted the %s outcome recorded once, got: %d more", test.outcome, n-before)
+			}
+		})
+	}
+}
+
+// sampleCount is how many sends of adapter ended with outcome.
+func sampleCount(t *testing.T, adapter string, outcome string) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := sendDuration.WithLabelValues(adapter, outcome).(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestCounters(t *testing.T) {
+	counters := []struct {
+		name    string
+		counter prometheus.Counter
+	}{
+		{"received", received.WithLabelValues("Rollout")},
+		{"routed", routed.WithLabelValues("slack", "Rollout")},
+		{"delivered", delivered.WithLabelValues("slack", "Rollout")},
+		{"retried", retried.WithLabelValues("slack", "Rollout")},
+		{"dropped", dropped.WithLabelValues("Rollout", ReasonStale)},
+	}
+	// The counters are global, so only the change is checked.
+	before := make([]float64, len(counters))
+	for i, c := range counters {
+		before[i] = testutil.ToFloat64(c.counter)
+	}
+
+	start := time.Now()
+	Received("Rollout")
+	Routed("slack", "Rollout")
+	Delivered("slack", "Rollout", start)
+	Retried("slack", "Rollout", start)
+	Dropped("Rollout", ReasonStale, start)
+
+	for i, c := range counters {
+		if got := testutil.ToFloat64(c.counter) - before[i]; got != 1 {
+			t.Errorf("%s: wanted 1, got: %v", c.name, got)
+		}
+	}
+}
+
+func TestResourceTypeIsBounded(t *testing.T) {
+	var testTable = []struct {
+		in   string
+		want string
+	}{
+		{"Release", "Release"},
+		{"Rollout", "Rollout"},
+		{"", "other"},
+		{"rel-20220101-abcdef", "other"},
+	}
+
+	for _, test := range testTable {
+		if got := ResourceType(test.in); got != test.want {
+			t.Errorf("ResourceType(%q) = %q, wanted %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Received("Release")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`deploybot_notifications_received_total{resource_type="Release"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("wanted %s in the metrics", want)
+		}
+	}
+}
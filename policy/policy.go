@@ -0,0 +1,214 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy decides which chat users may take which actions on the
+// pipelines. Chat users are mapped to GCP principals, which rules allow per
+// pipeline, target and action. Anything no rule allows is denied.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/bot"
+)
+
+// Any matches every pipeline, target or action of a rule.
+const Any = "*"
+
+// actions lists what rules can allow.
+var actions = []string{bot.ActionPromote, bot.ActionRollback, bot.ActionRetry, bot.ActionCancel, bot.ActionAdvance}
+
+// Policy is the "policy" section of the configuration file.
+type Policy struct {
+	// Users maps chat user IDs, Slack's member IDs like U0123ABCD or Google
+	// Chat's users/1234567890, to a principal like user:alice@example.com.
+	Users map[string]string `json:"users,omitempty"`
+	// Groups maps group principals, e.g. group:sre@example.com, to the
+	// principals of their members.
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []Rule              `json:"rules,omitempty"`
+}
+
+// Rule allows its principals to take its actions on its pipelines' targets.
+// Principals are user:EMAIL, serviceAccount:EMAIL, group:EMAIL or
+// domain:DOMAIN. Empty pipelines or targets match them all, actions must be
+// listed or be Any.
+type Rule struct {
+	Principals []string `json:"principals"`
+	Pipelines  []string `json:"pipelines,omitempty"`
+	Targets    []string `json:"targets,omitempty"`
+	Actions    []string `json:"actions"`
+}
+
+// Request is what a chat user asks to do.
+type Request struct {
+	// UserID is the chat user ID, as in Users.
+	UserID   string
+	Action   string
+	Pipeline string
+	Target   string
+}
+
+// Decision tells whether a Request is allowed, and why.
+type Decision struct {
+	Allowed bool
+	// Principal is what the user is mapped to, empty if unknown.
+	Principal string
+	// Rule is the index of the rule which allowed the request, -1 if none.
+	Rule   int
+	Reason string
+}
+
+// Validate checks the principals and actions of the policy.
+func (p *Policy) Validate() error {
+	var errs []error
+	for id, principal := range p.Users {
+		if err := checkPrincipal(principal); err != nil {
+			errs = append(errs, fmt.Errorf("policy user %s: %v", id, err))
+		}
+	}
+	for group, members := range p.Groups {
+		if !strings.HasPrefix(group, "group:") {
+			errs = append(errs, fmt.Errorf("policy group %s should look like group:EMAIL", group))
+		}
+		for _, member := range members {
+			if err := checkPrincipal(member); err != nil {
+				errs = append(errs, fmt.Errorf("policy group %s: %v", group, err))
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Principals) == 0 {
+			errs = append(errs, fmt.Errorf("policy rule %d has no principals", i))
+		}
+		for _, principal := range rule.Principals {
+			if err := checkPrincipal(principal); err != nil {
+				errs = append(errs, fmt.Errorf("policy rule %d: %v", i, err))
+			}
+		}
+		if len(rule.Actions) == 0 {
+			errs = append(errs, fmt.Errorf("policy rule %d has no actions", i))
+		}
+		for _, action := range rule.Actions {
+			if !contains(actions, action) && action != Any {
+				errs = append(errs, fmt.Errorf("policy rule %d: unknown action %q, should be one of %s or %s", i, action, strings.Join(actions, ", "), Any))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkPrincipal(principal string) error {
+	kind, name, ok := strings.Cut(principal, ":")
+	if !ok || name == "" || !contains([]string{"user", "serviceAccount", "group", "domain"}, kind) {
+		return fmt.Errorf("%q is not a principal like user:EMAIL, serviceAccount:EMAIL, group:EMAIL or domain:DOMAIN", principal)
+	}
+	return nil
+}
+
+// Decide tells whether r is allowed, and logs the decision. A nil Policy
+// denies everything.
+func (p *Policy) Decide(ctx context.Context, r Request) Decision {
+	d := p.decide(r)
+	slog.InfoContext(ctx, "policy decision",
+		"allowed", d.Allowed,
+		"user", r.UserID,
+		"principal", d.Principal,
+		"action", r.Action,
+		"pipeline", r.Pipeline,
+		"target", r.Target,
+		"rule", d.Rule,
+		"reason", d.Reason)
+	return d
+}
+
+// Principal is what the chat user with id is mapped to, empty if unknown.
+func (p *Policy) Principal(id string) string {
+	if p == nil {
+		return ""
+	}
+	return p.Users[id]
+}
+
+func (p *Policy) decide(r Request) Decision {
+	if p == nil {
+		return Decision{Rule: -1, Reason: "no policy is configured"}
+	}
+
+	principal, ok := p.Users[r.UserID]
+	if !ok {
+		return Decision{Rule: -1, Reason: "user is not mapped to a principal"}
+	}
+
+	identities := p.identities(principal)
+	for i, rule := range p.Rules {
+		if (contains(rule.Actions, Any) || contains(rule.Actions, r.Action)) && matches(rule.Pipelines, r.Pipeline) && matches(rule.Targets, r.Target) && overlaps(rule.Principals, identities) {
+			return Decision{Allowed: true, Principal: principal, Rule: i, Reason: fmt.Sprintf("allowed by rule %d", i)}
+		}
+	}
+	return Decision{Principal: principal, Rule: -1, Reason: "no rule allows it"}
+}
+
+// identities lists principal, its domain and the groups it belongs to,
+// directly or through other groups.
+func (p *Policy) identities(principal string) []string {
+	identities := []string{principal}
+	if _, email, ok := strings.Cut(principal, ":"); ok {
+		if _, domain, ok := strings.Cut(email, "@"); ok {
+			identities = append(identities, "domain:"+domain)
+		}
+	}
+
+	// Keep going until no new group is found, which also stops on cycles.
+	for found := true; found; {
+		found = false
+		for group, members := range p.Groups {
+			if !contains(identities, group) && overlaps(members, identities) {
+				identities = append(identities, group)
+				found = true
+			}
+		}
+	}
+	return identities
+}
+
+// matches tells whether value is in list, which matches everything when
+// empty or holding Any.
+func matches(list []string, value string) bool {
+	return len(list) == 0 || contains(list, Any) || contains(list, value)
+}
+
+func overlaps(a []string, b []string) bool {
+	for _, s := range a {
+		if contains(b, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+var testPolicy = &Policy{
+	Users: map[string]string{
+		"U0123ABCD":        "user:alice@example.com",
+		"users/1234567890": "user:alice@example.com",
+		"U0456EFGH":        "user:bob@example.com",
+		"U0789IJKL":        "user:carol@partner.com",
+	},
+	Groups: map[string][]string{
+		"group:sre@example.com":     {"user:alice@example.com"},
+		"group:oncall@example.com":  {"group:sre@example.com"},
+		"group:release@example.com": {"user:bob@example.com"},
+	},
+	Rules: []Rule{
+		{Principals: []string{"group:oncall@example.com"}, Targets: []string{"prod"}, Actions: []string{"rollback", "cancel"}},
+		{Principals: []string{"group:release@example.com"}, Pipelines: []string{"web-app"}, Actions: []string{"promote"}},
+		{Principals: []string{"domain:example.com"}, Targets: []string{"staging"}, Actions: []string{Any}},
+	},
+}
+
+func TestDecide(t *testing.T) {
+	var testTable = []struct {
+		name    string
+		request Request
+		allowed bool
+		rule    int
+	}{
+		{"Nested group", Request{"U0123ABCD", "rollback", "web-app", "prod"}, true, 0},
+		{"Same person on Chat", Request{"users/1234567890", "cancel", "api", "prod"}, true, 0},
+		{"Action not in rule", Request{"U0123ABCD", "promote", "web-app", "prod"}, false, -1},
+		{"Pipeline in rule", Request{"U0456EFGH", "promote", "web-app", "prod"}, true, 1},
+		{"Pipeline not in rule", Request{"U0456EFGH", "promote", "api", "prod"}, false, -1},
+		{"Domain and any action", Request{"U0456EFGH", "retry", "api", "staging"}, true, 2},
+		{"Other domain", Request{"U0789IJKL", "retry", "api", "staging"}, false, -1},
+		{"Unknown user", Request{"U9999", "retry", "api", "staging"}, false, -1},
+	}
+
+	for _, test := range testTable {
+		d := testPolicy.Decide(context.Background(), test.request)
+		if d.Allowed != test.allowed || d.Rule != test.rule {
+			t.Errorf("%s: wanted allowed %v by rule %d, got: %+v", test.name, test.allowed, test.rule, d)
+		}
+	}
+
+	var nilPolicy *Policy
+	if d := nilPolicy.Decide(context.Background(), Request{"U0123ABCD", "rollback", "web-app", "prod"}); d.Allowed {
+		t.Errorf("wanted no policy to deny everything, got: %+v", d)
+	}
+}
+
+func TestDecisionsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	testPolicy.Decide(context.Background(), Request{"U0456EFGH", "rollback", "web-app", "prod"})
+
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("could not decode log entry %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "policy decision" || entry["allowed"] != false || entry["principal"] != "user:bob@example.com" || entry["reason"] != "no rule allows it" {
+		t.Errorf("wanted the denial to be logged, got: %v", entry)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testPolicy.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	bad := &Policy{
+		Users:  map[string]string{"U1": "alice@example.com"},
+		Groups: map[string][]string{"sre": {"user:alice@example.com"}},
+		Rules: []Rule{
+			{Actions: []string{"promote"}},
+			{Principals: []string{"group:sre@example.com"}, Actions: []string{"approve"}},
+			{Principals: []string{"user:alice@example.com"}},
+		},
+	}
+	err := bad.Validate()
+	for _, want := range []string{
+		`policy user U1: "alice@example.com" is not a principal`,
+		"policy group sre should look like group:EMAIL",
+		"policy rule 0 has no principals",
+		`policy rule 1: unknown action "approve"`,
+		"policy rule 2 has no actions",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("wanted error containing %q, got: %v", want, err)
+		}
+	}
+}
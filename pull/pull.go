@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pull consumes a Pub/Sub subscription with streaming pull, for where
+// push endpoints aren't allowed, e.g. on GKE or VMs.
+package pull
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+)
+
+// Settings control how many messages are processed at once. Zero values keep
+// the Pub/Sub client's defaults.
+type Settings struct {
+	// Streams is the number of streaming pull connections.
+	Streams int
+	// MaxOutstandingMessages caps the messages being processed at once.
+	MaxOutstandingMessages int
+	// MaxOutstandingBytes caps the size of the messages being processed at once.
+	MaxOutstandingBytes int
+}
+
+// Receive hands every message of sub to process until ctx is done. A message
+// is acked once process succeeds, or nacked so Pub/Sub redelivers it later.
+// process should only return an error when the message is worth redelivering,
+// as CloudFuncPubSubCDOps does.
+func Receive(ctx context.Context, sub *pubsub.Subscriber, s Settings, process func(context.Context, gcpclouddeploy.OpsMessage) error) error {
+	if s.Streams > 0 {
+		sub.ReceiveSettings.NumGoroutines = s.Streams
+	}
+	if s.MaxOutstandingMessages != 0 {
+		sub.ReceiveSettings.MaxOutstandingMessages = s.MaxOutstandingMessages
+	}
+	if s.MaxOutstandingBytes != 0 {
+		sub.ReceiveSettings.MaxOutstandingBytes = s.MaxOutstandingBytes
+	}
+
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		m := gcpclouddeploy.OpsMessage{
+			ID:          msg.ID,
+			Data:        msg.Data,
+			Attributes:  msg.Attributes,
+			PublishTime: msg.PublishTime,
+		}
+
+		if err := process(ctx, m); err != nil {
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+	})
+}
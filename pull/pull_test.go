@@ -0,0 +1,132 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pull
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	pb "cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	testProject      = "myproject"
+	testTopic        = "projects/myproject/topics/clouddeploy-operations"
+	testSubscription = "projects/myproject/subscriptions/deploybot"
+)
+
+// testClient returns a client talking to the Pub/Sub emulator when
+// PUBSUB_EMULATOR_HOST is set, or to an in-memory fake otherwise, with the
+// topic and subscription created.
+func testClient(t *testing.T) *pubsub.Client {
+	t.Helper()
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		srv := pstest.NewServer()
+		t.Cleanup(func() { srv.Close() })
+
+		conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("could not connect to fake: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		opts = append(opts, option.WithGRPCConn(conn))
+	}
+
+	client, err := pubsub.NewClient(ctx, testProject, opts...)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if _, err := client.TopicAdminClient.CreateTopic(ctx, &pb.Topic{Name: testTopic}); err != nil {
+		t.Fatalf("could not create topic: %v", err)
+	}
+	t.Cleanup(func() { client.TopicAdminClient.DeleteTopic(ctx, &pb.DeleteTopicRequest{Topic: testTopic}) })
+
+	_, err = client.SubscriptionAdminClient.CreateSubscription(ctx, &pb.Subscription{
+		Name:               testSubscription,
+		Topic:              testTopic,
+		AckDeadlineSeconds: 10,
+	})
+	if err != nil {
+		t.Fatalf("could not create subscription: %v", err)
+	}
+	t.Cleanup(func() {
+		client.SubscriptionAdminClient.DeleteSubscription(ctx, &pb.DeleteSubscriptionRequest{Subscription: testSubscription})
+	})
+
+	return client
+}
+
+func TestReceive(t *testing.T) {
+	client := testClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	publisher := client.Publisher(testTopic)
+	defer publisher.Stop()
+	_, err := publisher.Publish(ctx, &pubsub.Message{
+		Data:       []byte("hello"),
+		Attributes: map[string]string{"ResourceType": "Rollout", "Action": "Succeed"},
+	}).Get(ctx)
+	if err != nil {
+		t.Fatalf("could not publish: %v", err)
+	}
+
+	// Fail the first delivery, so the message is nacked and redelivered.
+	var mu sync.Mutex
+	var attempts []gcpclouddeploy.OpsMessage
+	process := func(ctx context.Context, m gcpclouddeploy.OpsMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts = append(attempts, m)
+		if len(attempts) == 1 {
+			return errors.New("slack is down")
+		}
+		cancel()
+		return nil
+	}
+
+	err = Receive(ctx, client.Subscriber(testSubscription), Settings{Streams: 1, MaxOutstandingMessages: 1}, process)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 2 {
+		t.Fatalf("wanted the message redelivered once after a nack, got %d attempts", len(attempts))
+	}
+	m := attempts[1]
+	if string(m.Data) != "hello" || m.Attributes["ResourceType"] != "Rollout" || m.ID == "" || m.PublishTime.IsZero() {
+		t.Errorf("message was not converted: %+v", m)
+	}
+}
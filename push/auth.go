@@ -0,0 +1,331 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package push
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleJWKS is where Google publishes the keys signing its OIDC tokens.
+const GoogleJWKS = "https://www.googleapis.com/oauth2/v3/certs"
+
+// googleIssuers are the issuers Pub/Sub push tokens can carry.
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// clockSkew is how far the token times may be off from ours.
+const clockSkew = time.Minute
+
+// fetchInterval is how often the key set can be fetched, so tokens with made
+// up key IDs, or an unreachable endpoint, don't hammer it.
+const fetchInterval = time.Minute
+
+// fetchTimeout bounds fetching the key set, which the requests share.
+const fetchTimeout = 10 * time.Second
+
+// Verifier checks the OIDC token Pub/Sub attaches to authenticated push
+// requests, see https://cloud.google.com/pubsub/docs/authenticate-push-subscriptions
+type Verifier struct {
+	// Audience is the audience configured on the subscription. When empty
+	// the URL of the request is expected, which is Pub/Sub's default.
+	Audience string
+	// Email is the service account the subscription pushes as.
+	Email string
+	// Issuers defaults to Google's.
+	Issuers []string
+	// Keys checks the token signatures.
+	Keys *JWKS
+}
+
+// JWKS is a JSON Web Key Set read from a URL, or from a local file for tests.
+// Keys are cached and fetched again when a token uses an unknown key, at
+// most once per fetchInterval.
+type JWKS struct {
+	URL  string
+	File string
+	// HTTPClient is used to fetch URL, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+	// fetched is when the key set was last fetched, and err why it failed.
+	fetched time.Time
+	err     error
+	// fetching is closed once the fetch in progress, if any, is over.
+	fetching chan struct{}
+}
+
+// Authenticate wraps next so requests without a valid token get a 401.
+func (v *Verifier) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r.Context(), r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, fmt.Sprintf("unauthenticated: %v", err), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Verify checks the Authorization: Bearer token of r.
+func (v *Verifier) Verify(ctx context.Context, r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return errors.New("missing bearer token")
+	}
+
+	audience := v.Audience
+	if audience == "" {
+		audience = "https://" + r.Host + r.URL.Path
+	}
+
+	return v.verifyToken(ctx, strings.TrimPrefix(auth, "Bearer "), audience)
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      interface{} `json:"aud"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+	Expiry        int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+}
+
+func (v *Verifier) verifyToken(ctx context.Context, token string, audience string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	header := &tokenHeader{}
+	if err := decodeSegment(parts[0], header); err != nil {
+		return fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := v.Keys.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return errors.New("invalid token signature")
+	}
+
+	claims := &tokenClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)) {
+		return errors.New("token has expired")
+	}
+	if now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return errors.New("token used before issued")
+	}
+
+	issuers := v.Issuers
+	if len(issuers) == 0 {
+		issuers = googleIssuers
+	}
+	if !contains(issuers, claims.Issuer) {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !contains(audiences(claims.Audience), audience) {
+		return fmt.Errorf("unexpected audience, wanted %q", audience)
+	}
+	if claims.Email != v.Email || !claims.EmailVerified {
+		return fmt.Errorf("unexpected email %q", claims.Email)
+	}
+
+	return nil
+}
+
+// key returns the public key kid, fetching the key set again if it's unknown.
+// Concurrent requests share the fetch, which is made without holding the
+// lock so the known keys can still be read meanwhile.
+func (k *JWKS) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	for {
+		k.mu.Lock()
+		if key, ok := k.keys[kid]; ok {
+			k.mu.Unlock()
+			return key, nil
+		}
+		if !k.fetched.IsZero() && time.Since(k.fetched) < fetchInterval {
+			err := k.err
+			k.mu.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("could not fetch signing keys: %v", err)
+			}
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if fetching := k.fetching; fetching != nil {
+			k.mu.Unlock()
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		fetching := make(chan struct{})
+		k.fetching = fetching
+		k.mu.Unlock()
+
+		// The other requests wait for this fetch, so it mustn't end with
+		// this one.
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+		keys, err := k.fetch(fetchCtx)
+		cancel()
+
+		k.mu.Lock()
+		k.fetched, k.err = time.Now(), err
+		if err == nil {
+			k.keys = keys
+		}
+		k.fetching = nil
+		close(fetching)
+		k.mu.Unlock()
+	}
+}
+
+type jsonWebKeySet struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (k *JWKS) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	set := &jsonWebKeySet{}
+
+	if k.File != "" {
+		b, err := os.ReadFile(k.File)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, set); err != nil {
+			return nil, err
+		}
+	} else {
+		url := k.URL
+		if url == "" {
+			url = GoogleJWKS
+		}
+		client := http.DefaultClient
+		if k.HTTPClient != nil {
+			client = k.HTTPClient
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("request was not ok: %v", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus for key %q: %v", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("bad exponent for key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audiences handles "aud" being either a string or a list of strings.
+func audiences(aud interface{}) []string {
+	switch a := aud.(type) {
+	case string:
+		return []string{a}
+	case []interface{}:
+		var out []string
+		for _, item := range a {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
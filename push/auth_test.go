@@ -0,0 +1,235 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package push
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAudience = "https://deploybot.example.com/push"
+	testEmail    = "pusher@myproject.iam.gserviceaccount.com"
+)
+
+// signToken returns an RS256 JWT with claims, signed by key as kid.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("could not sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes the public half of key as kid to a key set file.
+func writeJWKS(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": kid,
+			"kty": "RSA",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	b, _ := json.Marshal(set)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		t.Fatalf("could not write key set: %v", err)
+	}
+	return file
+}
+
+func TestAuthenticate(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	verifier := &Verifier{
+		Audience: testAudience,
+		Email:    testEmail,
+		Keys:     &JWKS{File: writeJWKS(t, key, "key-1")},
+	}
+
+	now := time.Now()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            testAudience,
+			"email":          testEmail,
+			"email_verified": true,
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := valid()
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"valid", "Bearer " + signToken(t, key, "key-1", valid()), http.StatusNoContent},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"garbage", "Bearer not.a.token", http.StatusUnauthorized},
+		{"wrong key", "Bearer " + signToken(t, otherKey, "key-1", valid()), http.StatusUnauthorized},
+		{"unknown key", "Bearer " + signToken(t, key, "key-2", valid()), http.StatusUnauthorized},
+		{"wrong audience", "Bearer " + signToken(t, key, "key-1", with("aud", "https://elsewhere")), http.StatusUnauthorized},
+		{"wrong issuer", "Bearer " + signToken(t, key, "key-1", with("iss", "https://evil.example.com")), http.StatusUnauthorized},
+		{"wrong email", "Bearer " + signToken(t, key, "key-1", with("email", "someone@example.com")), http.StatusUnauthorized},
+		{"unverified email", "Bearer " + signToken(t, key, "key-1", with("email_verified", false)), http.StatusUnauthorized},
+		{"expired", "Bearer " + signToken(t, key, "key-1", with("exp", now.Add(-time.Hour).Unix())), http.StatusUnauthorized},
+	}
+
+	handler := verifier.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, testAudience, strings.NewReader(pushBody))
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: wanted status %d, got: %d %s", test.name, test.status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestDefaultAudienceIsRequestURL(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	verifier := &Verifier{Email: testEmail, Keys: &JWKS{File: writeJWKS(t, key, "key-1")}}
+
+	token := signToken(t, key, "key-1", map[string]interface{}{
+		"iss":            "accounts.google.com",
+		"aud":            []string{testAudience},
+		"email":          testEmail,
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+
+	req := httptest.NewRequest(http.MethodPost, testAudience, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if err := verifier.Verify(req.Context(), req); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestJWKSFetch(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	set, _ := os.ReadFile(writeJWKS(t, key, "key-1"))
+
+	var mu sync.Mutex
+	fetches, status := 0, http.StatusInternalServerError
+	arrived, release := make(chan struct{}, 10), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		code := status
+		mu.Unlock()
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		arrived <- struct{}{}
+		<-release
+		w.Write(set)
+	}))
+	defer server.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	// A failed fetch isn't tried again right away.
+	keys := &JWKS{URL: server.URL}
+	for i := 0; i < 2; i++ {
+		if _, err := keys.key(context.Background(), "key-1"); err == nil || !strings.Contains(err.Error(), "could not fetch signing keys") {
+			t.Errorf("wanted the fetch error, got: %v", err)
+		}
+	}
+	if n := count(); n != 1 {
+		t.Errorf("wanted 1 fetch after a failure, got: %d", n)
+	}
+
+	// Concurrent requests share a fetch.
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	keys.fetched = time.Now().Add(-fetchInterval)
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := keys.key(context.Background(), "key-1")
+			errs <- err
+		}()
+	}
+	<-arrived
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if n := count(); n != 2 {
+		t.Errorf("wanted the requests to share a fetch, got: %d fetches", n)
+	}
+
+	// Known keys are read while an unknown one is fetched.
+	keys.fetched = time.Now().Add(-fetchInterval)
+	release = make(chan struct{})
+	defer close(release)
+	go keys.key(context.Background(), "key-2")
+	<-arrived
+	if _, err := keys.key(context.Background(), "key-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
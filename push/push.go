@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package push serves Pub/Sub push subscriptions over HTTP, e.g. on Cloud Run.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/logging"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/metrics"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+)
+
+// maxBodySize is well above Pub/Sub's 10MB message limit once base64 encoded.
+const maxBodySize = 16 << 20
+
+// ProcessFunc handles a single message. It should only return an error when
+// the message is worth redelivering, as CloudFuncPubSubCDOps does.
+type ProcessFunc func(ctx context.Context, m gcpclouddeploy.OpsMessage) error
+
+// Handler decodes Pub/Sub push requests and hands their message to process.
+// A message is acked with 204 No Content, or nacked with 503 Service
+// Unavailable when process fails so Pub/Sub redelivers it later.
+func Handler(process ProcessFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Correlate the logs of this message with the request's trace.
+		traceID, spanID, sampled := logging.TraceFromRequest(r)
+		ctx := logging.WithTrace(r.Context(), traceID, spanID, sampled)
+
+		start := time.Now()
+		push := &gcpclouddeploy.PushRequest{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(push)
+		ctx = tracing.Parsed(ctx, start, err)
+		if err != nil {
+			_, span := tracing.StartReceive(ctx)
+			tracing.End(span, err)
+			metrics.Dropped("", metrics.ReasonInvalid, start)
+			http.Error(w, fmt.Sprintf("could not decode push request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := process(ctx, push.OpsMessage()); err != nil {
+			http.Error(w, fmt.Sprintf("could not process message %s: %v", push.Message.ID, err), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
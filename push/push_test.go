@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package push
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/gcpclouddeploy"
+	"github.com/GoogleCloudPlatform/cloud-deploy-chatbot/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const pushBody = `{
+	"message": {
+		"attributes": {"Action": "Succeed", "ResourceType": "Rollout", "ReleaseId": "rel-20"},
+		"data": "aGVsbG8=",
+		"messageId": "2070443601311540",
+		"publishTime": "2021-02-26T19:13:55.749Z"
+	},
+	"subscription": "projects/myproject/subscriptions/mysubscription"
+}`
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		err    error
+		status int
+	}{
+		{http.MethodPost, pushBody, nil, http.StatusNoContent},
+		{http.MethodPost, pushBody, errors.New("slack is down"), http.StatusServiceUnavailable},
+		{http.MethodPost, "not json", nil, http.StatusBadRequest},
+		{http.MethodGet, "", nil, http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		var got gcpclouddeploy.OpsMessage
+		handler := Handler(func(ctx context.Context, m gcpclouddeploy.OpsMessage) error {
+			got = m
+			return test.err
+		})
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(test.method, "/", strings.NewReader(test.body)))
+
+		if rec.Code != test.status {
+			t.Errorf("wanted status %d, got: %d", test.status, rec.Code)
+		}
+		if test.body != pushBody {
+			continue
+		}
+		if got.ID != "2070443601311540" || string(got.Data) != "hello" || got.Attributes["ReleaseId"] != "rel-20" {
+			t.Errorf("message was not decoded: %+v", got)
+		}
+		if got.PublishTime.IsZero() {
+			t.Errorf("wanted the publish time to be decoded")
+		}
+	}
+}
+
+func TestHandlerSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	tests := []struct {
+		body    string
+		wantErr bool
+	}{
+		{pushBody, false},
+		{"not json", true},
+	}
+
+	for _, test := range tests {
+		exporter.Reset()
+		// The receive span is started the way the Notifier does.
+		handler := Handler(func(ctx context.Context, m gcpclouddeploy.OpsMessage) error {
+			_, span := tracing.StartReceive(ctx)
+			span.End()
+			return nil
+		})
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body)))
+
+		spans := make(map[string]tracetest.SpanStub)
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		receive, parse := spans["deploybot.receive"], spans["deploybot.parse"]
+		if len(spans) != 2 || parse.Parent.SpanID() != receive.SpanContext.SpanID() {
+			t.Fatalf("%q: wanted deploybot.parse under deploybot.receive, got: %v", test.body, spans)
+		}
+		if receive.StartTime != parse.StartTime {
+			t.Errorf("%q: wanted deploybot.receive to start with the parsing", test.body)
+		}
+		if got := parse.Status.Code == codes.Error; got != test.wantErr {
+			t.Errorf("%q: wanted deploybot.parse failed %v, got: %v", test.body, test.wantErr, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package secrets resolves settings given as references to secrets, such as
+// sm://projects/PROJECT/secrets/NAME/versions/latest for Secret Manager.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+)
+
+// Prefix marks a value as a Secret Manager reference.
+const Prefix = "sm://"
+
+// Source returns the current value of a secret reference.
+type Source interface {
+	Access(ctx context.Context, ref string) (string, error)
+}
+
+// IsReference reports whether value refers to a secret rather than being one.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// SecretManager reads references from Google Cloud Secret Manager. The zero
+// value is ready to use, the client is created on first use.
+type SecretManager struct {
+	// Options are handed to the client, e.g. to use another endpoint.
+	Options []option.ClientOption
+
+	mu     sync.Mutex
+	client *secretmanager.Client
+}
+
+func (s *SecretManager) Access(ctx context.Context, ref string) (string, error) {
+	if !IsReference(ref) {
+		return "", fmt.Errorf("%q is not a Secret Manager reference", ref)
+	}
+
+	client, err := s.secretManager(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: strings.TrimPrefix(ref, Prefix),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not access %s: %v", ref, err)
+	}
+	return value(resp.GetPayload().GetData()), nil
+}
+
+// value is the secret held in data. Leading and trailing white space is
+// dropped, e.g. the newline left by echo TOKEN | gcloud secrets create,
+// which would break headers and URLs.
+func value(data []byte) string {
+	return strings.TrimSpace(string(data))
+}
+
+func (s *SecretManager) secretManager(ctx context.Context) (*secretmanager.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		// The client outlives the call which first needs it.
+		client, err := secretmanager.NewClient(context.WithoutCancel(ctx), s.Options...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create Secret Manager client: %v", err)
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// Memory holds secrets in memory, e.g. for tests. Like SecretManager, it
+// drops the white space around them.
+type Memory struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// Set stores value as the current version of ref.
+func (m *Memory) Set(ref string, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values == nil {
+		m.values = make(map[string]string)
+	}
+	m.values[ref] = value
+}
+
+func (m *Memory) Access(ctx context.Context, ref string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.values[ref]
+	if !ok {
+		return "", fmt.Errorf("could not access %s: not found", ref)
+	}
+	return value([]byte(v)), nil
+}
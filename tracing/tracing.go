@@ -0,0 +1,161 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing records OpenTelemetry spans for each notification, from its
+// receipt to the chat app's API call, and exports them over OTLP.
+package tracing
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/GoogleCloudPlatform/cloud-deploy-chatbot"
+
+// PubSubAttribute is the message attribute carrying the publisher's trace
+// context, as a W3C traceparent.
+const PubSubAttribute = "googclient_OpenTelemetryTraceContext"
+
+// pubSubTraceparent is where the Pub/Sub client libraries put it when their
+// own OpenTelemetry tracing is enabled.
+const pubSubTraceparent = "googclient_traceparent"
+
+// provider is the tracer provider set up by Setup, if any.
+var provider *sdktrace.TracerProvider
+
+// Setup exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, and does nothing otherwise. The
+// exporter reads the other OTEL_EXPORTER_OTLP_* variables, e.g. for headers.
+func Setup(ctx context.Context) error {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "deploybot")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// Shutdown exports the spans left, e.g. before the process exits.
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Flush exports the spans ended so far. Cloud Functions call it before
+// returning, as their instance may be frozen, or stopped, before the batch
+// is exported.
+func Flush(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.ForceFlush(ctx)
+}
+
+// Start starts a span using the global tracer provider.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error, opts ...trace.SpanEndOption) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(opts...)
+}
+
+// parsedKey holds how the message handled with a context was parsed.
+type parsedKey struct{}
+
+type parse struct {
+	start time.Time
+	end   time.Time
+	err   error
+}
+
+// Parsed records in ctx that its message was parsed from start until now,
+// failing with err if not nil. The trace of the message is only known once
+// it is parsed, so StartReceive adds the span covering the parsing then.
+func Parsed(ctx context.Context, start time.Time, err error) context.Context {
+	return context.WithValue(ctx, parsedKey{}, parse{start: start, end: time.Now(), err: err})
+}
+
+// StartReceive starts the deploybot.receive span of a Pub/Sub message in the
+// trace of ctx. When Parsed recorded the parsing of the message in ctx, the
+// span starts with it and gets a deploybot.parse child covering it.
+func StartReceive(ctx context.Context, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	opts = append([]trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.system", "gcp_pubsub")),
+	}, opts...)
+	p, parsed := ctx.Value(parsedKey{}).(parse)
+	if parsed {
+		opts = append(opts, trace.WithTimestamp(p.start))
+	}
+
+	ctx, span := Start(ctx, "deploybot.receive", opts...)
+	if parsed {
+		_, child := Start(ctx, "deploybot.parse", trace.WithTimestamp(p.start))
+		End(child, p.err, trace.WithTimestamp(p.end))
+	}
+	return ctx, span
+}
+
+// FromAttributes returns ctx with the publisher's trace found in the attributes
+// of a Pub/Sub message, so the notification's spans join that trace. ctx is
+// returned as is when there is none.
+func FromAttributes(ctx context.Context, attributes map[string]string) context.Context {
+	traceparent := attributes[PubSubAttribute]
+	if traceparent == "" {
+		traceparent = attributes[pubSubTraceparent]
+	}
+	if traceparent == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+func TestFromAttributes(t *testing.T) {
+	var testTable = []struct {
+		name       string
+		attributes map[string]string
+		traceID    string
+	}{
+		{"OpenTelemetryTraceContext", map[string]string{PubSubAttribute: traceparent}, "0af7651916cd43dd8448eb211c80319c"},
+		{"Client library", map[string]string{"googclient_traceparent": traceparent}, "0af7651916cd43dd8448eb211c80319c"},
+		{"Malformed", map[string]string{PubSubAttribute: "not a traceparent"}, ""},
+		{"None", map[string]string{"Action": "Start"}, ""},
+	}
+
+	for _, test := range testTable {
+		t.Run(test.name, func(t *testing.T) {
+			sc := trace.SpanContextFromContext(FromAttributes(context.Background(), test.attributes))
+
+			got := ""
+			if sc.IsValid() {
+				got = sc.TraceID().String()
+			}
+			if got != test.traceID {
+				t.Errorf("wanted trace %q, got: %q", test.traceID, got)
+			}
+		})
+	}
+}
+
+func TestStartAndEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx := FromAttributes(context.Background(), map[string]string{PubSubAttribute: traceparent})
+	_, ok := Start(ctx, "ok")
+	End(ok, nil)
+	_, failed := Start(ctx, "failed")
+	End(failed, errors.New("boom"))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("wanted 2 spans, got: %d", len(spans))
+	}
+	for _, span := range spans {
+		if span.Parent.SpanID().String() != "b7ad6b7169203331" {
+			t.Errorf("%s: wanted the publisher's span as parent, got: %s", span.Name, span.Parent.SpanID())
+		}
+	}
+	if spans[0].Status.Code != codes.Unset {
+		t.Errorf("wanted no error status, got: %v", spans[0].Status)
+	}
+	if spans[1].Status.Code != codes.Error || len(spans[1].Events) != 1 {
+		t.Errorf("wanted the error recorded, got: %v %v", spans[1].Status, spans[1].Events)
+	}
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	if err := Setup(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if provider != nil {
+		t.Errorf("wanted no exporter without an endpoint")
+	}
+	if err := Flush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	// A long batch timeout, so only Flush exports the span.
+	previous := otel.GetTracerProvider()
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(time.Hour)))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		provider = nil
+		otel.SetTracerProvider(previous)
+	})
+
+	_, span := Start(context.Background(), "deploybot.receive")
+	End(span, nil)
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Fatalf("wanted the span batched, got: %d exported", n)
+	}
+	if err := Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(exporter.GetSpans()); n != 1 {
+		t.Errorf("wanted the span exported, got: %d", n)
+	}
+}